@@ -0,0 +1,133 @@
+package audit
+
+import (
+	"encoding/json"
+	"raychat/settings"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+func Logger() *logrus.Entry {
+	return logrus.WithField("prefix", "audit")
+}
+
+// Record is a single line of the audit log
+type Record struct {
+	Time             time.Time       `json:"time"`
+	RequestID        string          `json:"request_id"`
+	Key              string          `json:"key,omitempty"`
+	Path             string          `json:"path"`
+	Status           int             `json:"status"`
+	Model            string          `json:"model,omitempty"`
+	Account          string          `json:"account,omitempty"`
+	Stream           bool            `json:"stream"`
+	PromptTokens     int             `json:"prompt_tokens"`
+	CompletionTokens int             `json:"completion_tokens"`
+	Request          json.RawMessage `json:"request,omitempty"`
+	Response         string          `json:"response,omitempty"`
+}
+
+var writer *lumberjack.Logger
+
+func init() {
+	conf := settings.Get()
+	if conf.AuditLog == "" {
+		return
+	}
+	writer = &lumberjack.Logger{
+		Filename:   conf.AuditLog,
+		MaxSize:    conf.AuditMaxSize,
+		MaxBackups: conf.AuditMaxFiles,
+	}
+}
+
+// Enabled reports whether AUDIT_LOG is set
+func Enabled() bool {
+	return writer != nil
+}
+
+// Write redacts r and appends it to the audit log
+func Write(r Record) {
+	if writer == nil {
+		return
+	}
+	r.Request = RedactJSON(r.Request)
+	r.Response = RedactString(r.Response)
+	line, err := json.Marshal(r)
+	if err != nil {
+		Logger().WithError(err).Error("encode audit record error")
+		return
+	}
+	if _, err := writer.Write(append(line, '\n')); err != nil {
+		Logger().WithError(err).Error("write audit log error")
+	}
+}
+
+const redacted = "[REDACTED]"
+
+// sensitiveFields are json fields whose value is always redacted
+var sensitiveFields = map[string]bool{
+	"password":      true,
+	"secret":        true,
+	"client_secret": true,
+	"token":         true,
+	"access_token":  true,
+	"refresh_token": true,
+	"api_key":       true,
+	"apikey":        true,
+	"key":           true,
+	"authorization": true,
+	"x-api-key":     true,
+}
+
+// secretPattern matches credentials inside free text, api keys and bearer tokens
+var secretPattern = regexp.MustCompile(`(?i)\b(sk-[A-Za-z0-9_-]{16,}|bearer\s+[A-Za-z0-9._~+/=-]{8,})`)
+
+// RedactString masks credentials found in text
+func RedactString(text string) string {
+	return secretPattern.ReplaceAllString(text, redacted)
+}
+
+// RedactJSON masks sensitive fields and credentials in string values, data
+// that is not valid json is redacted as a string
+func RedactJSON(data json.RawMessage) json.RawMessage {
+	if len(data) == 0 {
+		return data
+	}
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		raw, _ := json.Marshal(RedactString(string(data)))
+		return raw
+	}
+	raw, err := json.Marshal(redactValue(v))
+	if err != nil {
+		return nil
+	}
+	return raw
+}
+
+func redactValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, field := range v {
+			if sensitiveFields[strings.ToLower(k)] {
+				v[k] = redacted
+			} else {
+				v[k] = redactValue(field)
+			}
+		}
+		return v
+	case []any:
+		for i := range v {
+			v[i] = redactValue(v[i])
+		}
+		return v
+	case string:
+		return RedactString(v)
+	}
+	return v
+}
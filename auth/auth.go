@@ -1,7 +1,10 @@
 package auth
 
 import (
+	"fmt"
+	"net/http"
 	"net/url"
+	"raychat/transport"
 
 	"github.com/imroc/req/v3"
 	"github.com/sirupsen/logrus"
@@ -17,31 +20,43 @@ type RaycastAuth struct {
 	Email        string
 	Password     string
 	LoginResp    LoginResponse
+	// Transport sends the login requests, the shared default transport if nil
+	Transport http.RoundTripper
 }
 
-func (r *RaycastAuth) Login() string {
-	cli := req.C().
+func (r *RaycastAuth) Login() (StepFiveResponse, error) {
+	cli := transport.Req(r.Transport).
 		SetUserAgent("Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.5.2 Safari/605.1.15")
-	r1 := r.stepOne(cli)
-	r.stepTwo(cli, r1, r.ClientID)
-	r3 := r.stepThree(cli, r.Email, r.Password)
-	r4 := r.stepFour(cli, r3.RedirectTo)
-	r5 := r.stepFive(r4, r.ClientID, r.ClientSecret)
-	return r5.AccessToken
+	r1, err := r.stepOne(cli)
+	if err != nil {
+		return StepFiveResponse{}, err
+	}
+	if err := r.stepTwo(cli, r1, r.ClientID); err != nil {
+		return StepFiveResponse{}, err
+	}
+	r3, err := r.stepThree(cli, r.Email, r.Password)
+	if err != nil {
+		return StepFiveResponse{}, err
+	}
+	r4, err := r.stepFour(cli, r3.RedirectTo)
+	if err != nil {
+		return StepFiveResponse{}, err
+	}
+	return r.stepFive(r4, r.ClientID, r.ClientSecret)
 }
 
-func (r *RaycastAuth) stepOne(c *req.Client) StepOneResponse {
+func (r *RaycastAuth) stepOne(c *req.Client) (StepOneResponse, error) {
 	var resp StepOneResponse
 	rawResp, err := c.R().SetSuccessResult(&resp).Get("https://www.raycast.com/frontend_api/session")
-	if err != nil {
-		Logger().WithError(err).Panic("step one failed, raw response: ", rawResp)
+	if err := checkResponse("step one", rawResp, err); err != nil {
+		return resp, err
 	}
-	Logger().Info("step one success, authenticity token: ", resp.AuthenticityToken)
-	return resp
+	Logger().Info("step one success")
+	return resp, nil
 }
 
-func (r *RaycastAuth) stepTwo(c *req.Client, prev StepOneResponse, clientID string) {
-	c.R().
+func (r *RaycastAuth) stepTwo(c *req.Client, prev StepOneResponse, clientID string) error {
+	rawResp, err := c.R().
 		SetHeaders(map[string]string{
 			"Accept":          "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
 			"Accept-Language": "zh-CN,zh-Hans;q=0.9",
@@ -57,10 +72,15 @@ func (r *RaycastAuth) stepTwo(c *req.Client, prev StepOneResponse, clientID stri
 			"&" + "response_type=code" +
 			"&" + "audience=" +
 			"&" + "scope=")
+	return checkResponse("step two", rawResp, err)
 }
 
-func (r *RaycastAuth) stepThree(c *req.Client, email, password string) LoginResponse {
+func (r *RaycastAuth) stepThree(c *req.Client, email, password string) (LoginResponse, error) {
 	var resp LoginResponse
+	csrfToken, err := getCSRFToken(c)
+	if err != nil {
+		return resp, err
+	}
 	rawResp, err := c.R().SetSuccessResult(&resp).
 		SetHeaders(map[string]string{
 			"Accept":          "application/json",
@@ -71,7 +91,7 @@ func (r *RaycastAuth) stepThree(c *req.Client, email, password string) LoginResp
 			"Content-Type":    "application/json",
 			"Origin":          "https://www.raycast.com",
 			"Referer":         "https://www.raycast.com/users/sign_in",
-			"X-CSRF-Token":    getCSRFToken(c),
+			"X-CSRF-Token":    csrfToken,
 		}).
 		SetBody(map[string]map[string]string{
 			"user": {
@@ -80,17 +100,24 @@ func (r *RaycastAuth) stepThree(c *req.Client, email, password string) LoginResp
 			},
 		}).
 		Post("https://www.raycast.com/frontend_api/session")
-	if err != nil {
-		Logger().WithError(err).Panic("login failed, raw response: ", rawResp.String())
+	if err := checkResponse("step three", rawResp, err); err != nil {
+		return resp, err
+	}
+	if resp.RedirectTo == "" {
+		return resp, fmt.Errorf("%w: step three: no redirect in login response", ErrUpstreamAuth)
 	}
-	Logger().Infof("login success, resp: %+v", rawResp.String())
+	Logger().WithField("email", resp.User.Email).Info("login success")
 	r.LoginResp = resp
-	return resp
+	return resp, nil
 }
 
-func (r *RaycastAuth) stepFour(c *req.Client, redirUrl string) string {
+func (r *RaycastAuth) stepFour(c *req.Client, redirUrl string) (string, error) {
 	url := "https://www.raycast.com" + redirUrl
-	Logger().Info("redirect url: ", url)
+	Logger().Info("step four, follow login redirect")
+	csrfToken, err := getCSRFToken(c)
+	if err != nil {
+		return "", err
+	}
 	resp, err := c.SetRedirectPolicy(req.NoRedirectPolicy()).R().SetHeaders(map[string]string{
 		"Accept":          "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
 		"Accept-Language": "zh-CN,zh-Hans;q=0.9",
@@ -99,21 +126,23 @@ func (r *RaycastAuth) stepFour(c *req.Client, redirUrl string) string {
 		"Sec-Fetch-Dest":  "document",
 		"Content-Type":    "application/json",
 		"Referer":         "https://www.raycast.com/users/sign_in",
-		"X-CSRF-Token":    getCSRFToken(c),
+		"X-CSRF-Token":    csrfToken,
 	}).Get(url)
-	if err != nil {
-		Logger().WithError(err).Panic("step four redirect failed")
+	if err := checkResponse("step four", resp, err); err != nil {
+		return "", err
 	}
 	redir := resp.GetHeader("Location")
-	return redir
+	if redir == "" {
+		return "", fmt.Errorf("%w: step four: no redirect location", ErrUpstreamAuth)
+	}
+	return redir, nil
 }
 
-func (r *RaycastAuth) stepFive(redirUrl, clientID, clientSecret string) StepFiveResponse {
-	Logger().Info("redirect url: ", redirUrl)
+func (r *RaycastAuth) stepFive(redirUrl, clientID, clientSecret string) (StepFiveResponse, error) {
+	Logger().Info("step five, exchange authorization code")
 	parsedURL, err := url.Parse(redirUrl)
 	if err != nil {
-		Logger().WithError(err).Panic("parse redirect url failed")
-		return StepFiveResponse{}
+		return StepFiveResponse{}, fmt.Errorf("%w: step five: parse redirect url: %v", ErrBadUpstreamPayload, err)
 	}
 	qp := map[string]string{}
 	queryParams := parsedURL.Query()
@@ -124,7 +153,7 @@ func (r *RaycastAuth) stepFive(redirUrl, clientID, clientSecret string) StepFive
 	}
 
 	var resp StepFiveResponse
-	cli := req.C().SetUserAgent("Raycast/0 CFNetwork/1408.0.4 Darwin/22.5.0")
+	cli := transport.Req(r.Transport).SetUserAgent("Raycast/0 CFNetwork/1408.0.4 Darwin/22.5.0")
 	rawResp, err := cli.R().SetSuccessResult(&resp).
 		SetHeaders(map[string]string{
 			"Content-Type":    "application/x-www-form-urlencoded",
@@ -139,22 +168,25 @@ func (r *RaycastAuth) stepFive(redirUrl, clientID, clientSecret string) StepFive
 			"client_secret": clientSecret,
 		}).
 		Post("https://www.raycast.com/oauth/token")
-	if err != nil {
-		Logger().WithError(err).Panic("step five failed, raw response: ", rawResp.String())
+	if err := checkResponse("step five", rawResp, err); err != nil {
+		return resp, err
+	}
+	if resp.AccessToken == "" {
+		return resp, fmt.Errorf("%w: step five: no access token in response", ErrBadUpstreamPayload)
 	}
-	Logger().Info("step five success, resp: ", resp)
-	return resp
+	Logger().WithField("username", resp.Data.Username).Info("step five success")
+	return resp, nil
 }
 
-func getCSRFToken(c *req.Client) string {
+func getCSRFToken(c *req.Client) (string, error) {
 	cookies, err := c.GetCookies("https://www.raycast.com")
 	if err != nil {
-		Logger().WithError(err).Panic("get csrf token failed")
+		return "", fmt.Errorf("%w: get csrf token: %v", ErrBadUpstreamPayload, err)
 	}
 	for _, t := range cookies {
 		if t.Name == "csrf_token" {
-			return t.Value
+			return t.Value, nil
 		}
 	}
-	return ""
+	return "", nil
 }
@@ -0,0 +1,31 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/imroc/req/v3"
+)
+
+var (
+	ErrUpstreamAuth        = errors.New("raycast authentication failed")
+	ErrUpstreamUnavailable = errors.New("raycast unavailable")
+	ErrBadUpstreamPayload  = errors.New("bad raycast payload")
+)
+
+// checkResponse turns a failed request of a login step into a typed error
+func checkResponse(step string, resp *req.Response, err error) error {
+	if err != nil && resp != nil && resp.IsSuccessState() {
+		return fmt.Errorf("%w: %s: %v", ErrBadUpstreamPayload, step, err)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrUpstreamUnavailable, step, err)
+	}
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("%w: %s: status %d", ErrUpstreamUnavailable, step, resp.StatusCode)
+	}
+	if resp.IsErrorState() {
+		return fmt.Errorf("%w: %s: status %d", ErrUpstreamAuth, step, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"raychat/metrics"
+	"sync/atomic"
+	"time"
+)
+
+// minRefreshInterval keeps a failing login from hammering raycast
+const minRefreshInterval = 30 * time.Second
+
+type tokenState struct {
+	Token     string
+	CreatedAt time.Time
+	User      User
+}
+
+// TokenManager keeps the raycast access token fresh, it re-runs the login flow in
+// the background when the token is older than ttl or was rejected by raycast.
+// Tokens configured statically can not be refreshed and are served as is.
+type TokenManager struct {
+	account     string
+	auth        *RaycastAuth
+	ttl         time.Duration
+	state       atomic.Pointer[tokenState]
+	refreshing  atomic.Bool
+	lastAttempt atomic.Int64
+}
+
+func NewStaticTokenManager(token string) *TokenManager {
+	m := &TokenManager{}
+	m.state.Store(&tokenState{Token: token, CreatedAt: time.Now()})
+	return m
+}
+
+// NewTokenManager logs in synchronously and returns a manager holding the fresh token
+func NewTokenManager(account string, a *RaycastAuth, ttl time.Duration) (*TokenManager, error) {
+	m := &TokenManager{account: account, auth: a, ttl: ttl}
+	state, err := m.login("login")
+	if err != nil {
+		return nil, err
+	}
+	m.state.Store(state)
+	return m, nil
+}
+
+func (m *TokenManager) Token() string {
+	s := m.state.Load()
+	if m.ttl > 0 && time.Since(s.CreatedAt) > m.ttl {
+		m.refresh("token expired")
+	}
+	return s.Token
+}
+
+func (m *TokenManager) User() User {
+	return m.state.Load().User
+}
+
+func (m *TokenManager) CreatedAt() time.Time {
+	return m.state.Load().CreatedAt
+}
+
+// Invalidate reports that token was rejected by raycast. A refresh is only
+// started when token is still the current one, so concurrent failures with the
+// same token trigger a single login.
+func (m *TokenManager) Invalidate(token string) {
+	if m.state.Load().Token != token {
+		return
+	}
+	m.refresh("token rejected by raycast")
+}
+
+func (m *TokenManager) refresh(reason string) {
+	if m.auth == nil {
+		Logger().Warnf("%s, but token is configured statically and can not be refreshed", reason)
+		return
+	}
+	if time.Since(time.Unix(0, m.lastAttempt.Load())) < minRefreshInterval {
+		return
+	}
+	if !m.refreshing.CompareAndSwap(false, true) {
+		return
+	}
+	m.lastAttempt.Store(time.Now().UnixNano())
+	Logger().Infof("%s, refreshing token in background", reason)
+	go func() {
+		defer m.refreshing.Store(false)
+		state, err := m.login("refresh")
+		if err != nil {
+			Logger().WithError(err).Error("refresh token failed, keep the old one")
+			return
+		}
+		m.state.Store(state)
+		Logger().Info("refresh token success")
+	}()
+}
+
+func (m *TokenManager) login(kind string) (*tokenState, error) {
+	// login on a copy so the shared auth is never written concurrently
+	a := *m.auth
+	resp, err := a.Login()
+	if err != nil {
+		metrics.LoginAttempts.WithLabelValues(m.account, kind, "failure").Inc()
+		return nil, err
+	}
+	metrics.LoginAttempts.WithLabelValues(m.account, kind, "success").Inc()
+	createdAt := time.Now()
+	if resp.CreatedAt > 0 {
+		createdAt = time.Unix(int64(resp.CreatedAt), 0)
+	}
+	return &tokenState{
+		Token:     resp.AccessToken,
+		CreatedAt: createdAt,
+		User:      a.LoginResp.User,
+	}, nil
+}
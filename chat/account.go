@@ -0,0 +1,145 @@
+package chat
+
+import (
+	"fmt"
+	"net/http"
+	"raychat/auth"
+	"raychat/metrics"
+	"raychat/settings"
+	"raychat/transport"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Account is a single raycast account in the pool, with its own token and model catalog
+type Account struct {
+	Name          string
+	conf          settings.AccountConfig
+	transport     *http.Transport
+	tokens        *auth.TokenManager
+	breaker       *breaker
+	aiInfo        GetAIInfoResponse
+	aiInfoAt      time.Time
+	models        map[string]string
+	inflight      atomic.Int64
+	fanout        atomic.Int64
+	cooldownUntil atomic.Int64
+}
+
+func loadAccount(conf settings.AccountConfig, ttl time.Duration) (*Account, error) {
+	t, err := transport.Get(conf.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("account %s: %w", conf.Name, err)
+	}
+	account := &Account{Name: conf.Name, conf: conf, transport: t}
+	if conf.Token != "" {
+		account.tokens = auth.NewStaticTokenManager(conf.Token)
+	} else {
+		tokens, err := auth.NewTokenManager(conf.Name, &auth.RaycastAuth{
+			ClientID:     conf.ClientID,
+			ClientSecret: conf.ClientSecret,
+			Email:        conf.Email,
+			Password:     conf.Password,
+			Transport:    t,
+		}, ttl)
+		if err != nil {
+			return nil, fmt.Errorf("login account %s: %w", conf.Name, err)
+		}
+		account.tokens = tokens
+	}
+	aiInfo, err := account.Cli(account.Token()).GetAIInfo()
+	if err != nil {
+		return nil, fmt.Errorf("get models of account %s: %w", conf.Name, err)
+	}
+	account.aiInfo = aiInfo
+	account.aiInfoAt = time.Now()
+	account.models = account.aiInfo.SupporedModels()
+	user := account.tokens.User()
+	for _, m := range user.AiChatModels {
+		if _, ok := account.models[m.Model]; !ok {
+			account.models[m.Model] = m.Provider
+		}
+	}
+	if _, ok := account.models["gpt-4"]; !ok && user.EligibleForGpt4 {
+		account.models["gpt-4"] = "openai"
+	}
+	return account, nil
+}
+
+func (a *Account) Logger() *logrus.Entry {
+	return Logger().WithField("account", a.Name)
+}
+
+func (a *Account) Token() string {
+	return a.tokens.Token()
+}
+
+// Cli returns a raycast client sending through the proxy of the account
+func (a *Account) Cli(token string) *RayChat {
+	return &RayChat{Token: token, Transport: a.transport}
+}
+
+// Models returns the models this account is eligible for, keyed by model with provider as value
+func (a *Account) Models() map[string]string {
+	return a.models
+}
+
+func (a *Account) Supports(model string) bool {
+	_, ok := a.models[model]
+	return ok
+}
+
+func (a *Account) Inflight() int64 {
+	return a.inflight.Load()
+}
+
+func (a *Account) Available() bool {
+	return time.Now().UnixNano() >= a.cooldownUntil.Load()
+}
+
+func (a *Account) Release() {
+	a.inflight.Add(-1)
+}
+
+// reserveFanout takes a fan-out slot if fewer than limit are taken
+func (a *Account) reserveFanout(limit int) bool {
+	for {
+		n := a.fanout.Load()
+		if n >= int64(limit) {
+			return false
+		}
+		if a.fanout.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// Eject keeps the account out of rotation for the cool-down period
+func (a *Account) Eject(cooldown time.Duration, reason string) {
+	a.cooldownUntil.Store(time.Now().Add(cooldown).UnixNano())
+	metrics.AccountEjections.WithLabelValues(a.Name).Inc()
+	a.Logger().Warnf("account ejected for %s: %s", cooldown, reason)
+}
+
+// ReportStatus inspects the raycast response status of a request made with token,
+// rejected tokens are refreshed, quota, auth and server errors eject the
+// account and server errors count towards its circuit breaker as well.
+func (a *Account) ReportStatus(token string, statusCode int, cooldown time.Duration) {
+	switch {
+	case statusCode == 401 || statusCode == 403:
+		a.tokens.Invalidate(token)
+		a.Eject(cooldown, fmt.Sprintf("unauthorized, status %d", statusCode))
+	case statusCode == 402 || statusCode == 429:
+		a.Eject(cooldown, fmt.Sprintf("quota exceeded, status %d", statusCode))
+	case statusCode >= 500:
+		a.Eject(cooldown, fmt.Sprintf("server error, status %d", statusCode))
+		if a.breaker.Failure() {
+			metrics.CircuitOpens.WithLabelValues(a.Name).Inc()
+			a.Logger().Warnf("circuit open after repeated failures, last status %d", statusCode)
+		}
+	case statusCode == 200:
+		a.breaker.Success()
+	}
+}
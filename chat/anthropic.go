@@ -0,0 +1,313 @@
+package chat
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/samber/lo"
+)
+
+type AnthropicRequest struct {
+	Model         string             `json:"model"`
+	Messages      []AnthropicMessage `json:"messages"`
+	System        AnthropicContent   `json:"system"`
+	MaxTokens     int                `json:"max_tokens"`
+	StopSequences []string           `json:"stop_sequences"`
+	Stream        bool               `json:"stream"`
+	Temperature   float64            `json:"temperature"`
+}
+
+type AnthropicMessage struct {
+	Role    string           `json:"role"`
+	Content AnthropicContent `json:"content"`
+}
+
+type AnthropicContentBlock struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// AnthropicContent is either a plain string or a list of content blocks
+type AnthropicContent []AnthropicContentBlock
+
+func (c *AnthropicContent) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = AnthropicContent{{Type: "text", Text: text}}
+		return nil
+	}
+	var blocks []AnthropicContentBlock
+	if err := json.Unmarshal(data, &blocks); err != nil {
+		return err
+	}
+	*c = blocks
+	return nil
+}
+
+// Text joins the text blocks, only text content can be sent to raycast
+func (c AnthropicContent) Text() (string, error) {
+	texts := []string{}
+	for _, block := range c {
+		if block.Type != "text" {
+			return "", fmt.Errorf("%w: unsupported content block type %q", ErrInvalidRequest, block.Type)
+		}
+		texts = append(texts, block.Text)
+	}
+	return strings.Join(texts, "\n"), nil
+}
+
+func (r AnthropicRequest) ToRayChatRequest() (RayChatRequest, error) {
+	messages := make([]RayChatMessage, 0, len(r.Messages))
+	for _, m := range r.Messages {
+		text, err := m.Content.Text()
+		if err != nil {
+			return RayChatRequest{}, err
+		}
+		messages = append(messages, RayChatMessage{
+			Content: Content{Text: text},
+			Author:  m.Role,
+		})
+	}
+	system, err := r.System.Text()
+	if err != nil {
+		return RayChatRequest{}, err
+	}
+	if r.Temperature == 0 {
+		r.Temperature = 1
+	}
+
+	model, provider, err := resolveModel(r.Model)
+	if err != nil {
+		return RayChatRequest{}, err
+	}
+
+	return RayChatRequest{
+		Debug:                        false,
+		Locale:                       "en-CN",
+		Provider:                     provider,
+		Model:                        model,
+		Temperature:                  r.Temperature,
+		SystemInstruction:            "markdown",
+		AdditionalSystemInstructions: system,
+		Messages:                     messages,
+	}, nil
+}
+
+type AnthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type AnthropicResponse struct {
+	ID           string                  `json:"id"`
+	Type         string                  `json:"type"`
+	Role         string                  `json:"role"`
+	Model        string                  `json:"model"`
+	Content      []AnthropicContentBlock `json:"content"`
+	StopReason   *string                 `json:"stop_reason"`
+	StopSequence *string                 `json:"stop_sequence"`
+	Usage        AnthropicUsage          `json:"usage"`
+}
+
+type AnthropicErrorResponse struct {
+	Type  string `json:"type"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// NewAnthropicErrorResponse maps err to its http status and anthropic error envelope
+func NewAnthropicErrorResponse(err error) (int, AnthropicErrorResponse) {
+	status, _ := NewErrorResponse(err)
+	resp := AnthropicErrorResponse{Type: "error"}
+	resp.Error.Message = err.Error()
+	switch status {
+	case http.StatusBadRequest:
+		resp.Error.Type = "invalid_request_error"
+	case http.StatusForbidden:
+		resp.Error.Type = "permission_error"
+	case http.StatusNotFound:
+		resp.Error.Type = "not_found_error"
+	case http.StatusTooManyRequests:
+		resp.Error.Type = "rate_limit_error"
+	case http.StatusServiceUnavailable:
+		resp.Error.Type = "overloaded_error"
+	default:
+		resp.Error.Type = "api_error"
+	}
+	return status, resp
+}
+
+// anthropicStopReason maps the raycast finish reason and the enforced limits to
+// the anthropic stop reason and the stop sequence hit
+func anthropicStopReason(finishReason *string, limiter *outputLimiter) (string, *string) {
+	if limiter.FinishReason() != nil {
+		finishReason = limiter.FinishReason()
+	}
+	switch {
+	case limiter.StopSequence() != nil:
+		return "stop_sequence", limiter.StopSequence()
+	case finishReason != nil && *finishReason == "length":
+		return "max_tokens", nil
+	}
+	return "end_turn", nil
+}
+
+func MessagesEndpoint(c *gin.Context) {
+	originReq := &AnthropicRequest{}
+	if err := c.Copy().ShouldBindJSON(originReq); err != nil {
+		abortWithAnthropicError(c, fmt.Errorf("%w: %v", ErrInvalidRequest, err))
+		return
+	}
+	rayChatReq, err := originReq.ToRayChatRequest()
+	if err == nil {
+		err = checkModelAllowed(c, originReq.Model, rayChatReq.Model)
+	}
+	if err != nil {
+		abortWithAnthropicError(c, err)
+		return
+	}
+	rayChatReq, sources, err := sendChoices(c, originReq.Model, originReq.Stream, nil, []RayChatRequest{rayChatReq})
+	if err != nil {
+		abortWithAnthropicError(c, err)
+		return
+	}
+
+	id := "msg_" + generateRandomString(24)
+	limiter := newOutputLimiter(rayChatReq.Model, originReq.StopSequences, originReq.MaxTokens)
+	if originReq.Stream {
+		anthropicStreamResp(c, id, rayChatReq, limiter, sources)
+		return
+	}
+
+	// there is a single choice, its source is already open
+	r, done, _ := sources[0](c.Request.Context())
+	defer done()
+	content := strings.Builder{}
+	var finishReason *string
+	err = readEvents(r.Body, func(rayChatResp RayChatStreamResponse) error {
+		content.WriteString(limiter.Write(rayChatResp.Text))
+		if rayChatResp.FinishReason != nil {
+			finishReason = rayChatResp.FinishReason
+		}
+		if limiter.Done() {
+			return errLimitReached
+		}
+		return nil
+	})
+	if err != nil {
+		abortWithAnthropicError(c, err)
+		return
+	}
+	content.WriteString(limiter.Close())
+	usage := recordUsage(c, rayChatReq.Model, rayChatReq.PromptTokens(), []string{content.String()})
+	stopReason, stopSequence := anthropicStopReason(finishReason, limiter)
+	c.JSON(http.StatusOK, AnthropicResponse{
+		ID:           id,
+		Type:         "message",
+		Role:         "assistant",
+		Model:        rayChatReq.Model,
+		Content:      []AnthropicContentBlock{{Type: "text", Text: content.String()}},
+		StopReason:   lo.ToPtr(stopReason),
+		StopSequence: stopSequence,
+		Usage: AnthropicUsage{
+			InputTokens:  usage.PromptTokens,
+			OutputTokens: usage.CompletionTokens,
+		},
+	})
+}
+
+func anthropicStreamResp(c *gin.Context, id string, rayChatReq RayChatRequest, limiter *outputLimiter, sources []choiceSource) {
+	if err := beginStream(c, sources, "text/event-stream"); err != nil {
+		abortWithAnthropicError(c, err)
+		return
+	}
+	resp, done, _ := sources[0](c.Request.Context())
+	defer done()
+	defer countStream(c, rayChatReq.Model)()
+
+	writeEvent := func(event string, data any) error {
+		rawData, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		if _, err := c.Writer.WriteString("event: " + event + "\ndata: " + string(rawData) + "\n\n"); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	}
+
+	var finishReason *string
+	err := writeEvent("message_start", gin.H{
+		"type": "message_start",
+		"message": AnthropicResponse{
+			ID:      id,
+			Type:    "message",
+			Role:    "assistant",
+			Model:   rayChatReq.Model,
+			Content: []AnthropicContentBlock{},
+			Usage:   AnthropicUsage{InputTokens: rayChatReq.PromptTokens()},
+		},
+	})
+	if err == nil {
+		err = writeEvent("content_block_start", gin.H{
+			"type":          "content_block_start",
+			"index":         0,
+			"content_block": AnthropicContentBlock{Type: "text", Text: ""},
+		})
+	}
+	completion := strings.Builder{}
+	writeText := func(text string) error {
+		completion.WriteString(text)
+		if len(text) == 0 {
+			return nil
+		}
+		return writeEvent("content_block_delta", gin.H{
+			"type":  "content_block_delta",
+			"index": 0,
+			"delta": gin.H{"type": "text_delta", "text": text},
+		})
+	}
+	if err == nil {
+		err = readEvents(resp.Body, func(rayChatResp RayChatStreamResponse) error {
+			if rayChatResp.FinishReason != nil {
+				finishReason = rayChatResp.FinishReason
+			}
+			if err := writeText(limiter.Write(rayChatResp.Text)); err != nil {
+				return err
+			}
+			if limiter.Done() {
+				return errLimitReached
+			}
+			return nil
+		})
+	}
+	if err == nil {
+		err = writeText(limiter.Close())
+	}
+	usage := recordUsage(c, rayChatReq.Model, rayChatReq.PromptTokens(), []string{completion.String()})
+	if streamFailed(c, err, func(err error) {
+		_, errResp := NewAnthropicErrorResponse(err)
+		writeEvent("error", errResp)
+	}) {
+		return
+	}
+	stopReason, stopSequence := anthropicStopReason(finishReason, limiter)
+	writeEvent("content_block_stop", gin.H{"type": "content_block_stop", "index": 0})
+	writeEvent("message_delta", gin.H{
+		"type":  "message_delta",
+		"delta": gin.H{"stop_reason": stopReason, "stop_sequence": stopSequence},
+		"usage": gin.H{"output_tokens": usage.CompletionTokens},
+	})
+	writeEvent("message_stop", gin.H{"type": "message_stop"})
+}
+
+func abortWithAnthropicError(c *gin.Context, err error) {
+	status, resp := NewAnthropicErrorResponse(err)
+	c.AbortWithStatusJSON(status, resp)
+}
@@ -1,43 +1,33 @@
 package chat
 
 import (
-	"raychat/auth"
+	"raychat/metrics"
 	"raychat/settings"
+	"time"
 )
 
-var (
-	authInstance *auth.RaycastAuth
-	token        string
-	models       map[string]string
-)
-
-func init() {
-	initAuth()
-	initModels()
-}
-
-func initAuth() {
-	if settings.Get().Token != "" {
-		token = settings.Get().Token
-		return
-	}
-	authInstance = &auth.RaycastAuth{
-		ClientID:     settings.Get().ClientID,
-		ClientSecret: settings.Get().ClientSecret,
-		Email:        settings.Get().Email,
-		Password:     settings.Get().Password,
-	}
-	token = authInstance.Login()
-}
+// pool is empty until Init loads the accounts
+var pool = &Pool{}
 
-func initModels() {
-	models = Cli(getToken()).GetSupportedModels()
+// Init loads the raycast accounts of conf and keeps them in sync with config
+// reloads, it is called by the server and not on import so tools and tests
+// using the package do not log in to raycast
+func Init(conf settings.RayConfig) {
+	pool = NewPool(conf)
+	metrics.SetModelCatalog(func(model string) bool {
+		_, ok := getPool().ModelInfo(model)
+		return ok
+	})
+	settings.OnChange(func(_, conf settings.RayConfig) {
+		pool.Apply(conf)
+	})
 }
 
-func getToken() string {
-	return token
+// GetModelInfos returns the model catalog fetched from raycast and the time it was fetched
+func GetModelInfos() ([]ModelInfo, time.Time) {
+	return pool.ModelInfos()
 }
 
-func getAuthInstance() *auth.RaycastAuth {
-	return authInstance
+func getPool() *Pool {
+	return pool
 }
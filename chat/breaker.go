@@ -0,0 +1,80 @@
+package chat
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = fmt.Errorf("%w: raycast is failing, circuit open", ErrUpstreamUnavailable)
+
+// breaker is the circuit breaker of an account, it opens after threshold
+// consecutive connection or server errors and fast-fails requests until the
+// cool-down is over, then lets a single trial request through. A zero
+// threshold disables it.
+type breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{threshold: threshold, cooldown: cooldown}
+}
+
+// Configure changes the threshold and the cool-down, the failure count is kept
+func (b *breaker) Configure(threshold int, cooldown time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.threshold, b.cooldown = threshold, cooldown
+}
+
+// Ready reports whether a request may be sent now, it does not claim the
+// trial request of an open circuit, TryAcquire does
+func (b *breaker) Ready() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.open() || !time.Now().Before(b.openUntil)
+}
+
+// TryAcquire claims a request, if the circuit is open and the cool-down is
+// over only the first caller gets the trial request and everyone else waits
+// another cool-down for its result
+func (b *breaker) TryAcquire() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open() {
+		return true
+	}
+	now := time.Now()
+	if now.Before(b.openUntil) {
+		return false
+	}
+	b.openUntil = now.Add(b.cooldown)
+	return true
+}
+
+func (b *breaker) open() bool {
+	return b.threshold > 0 && b.failures >= b.threshold
+}
+
+func (b *breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.openUntil = time.Time{}
+}
+
+// Failure counts a failed request and reports whether the circuit opened
+func (b *breaker) Failure() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.threshold <= 0 || b.failures < b.threshold {
+		return false
+	}
+	b.openUntil = time.Now().Add(b.cooldown)
+	return b.failures == b.threshold
+}
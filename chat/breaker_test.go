@@ -0,0 +1,85 @@
+package chat
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	const cooldown = 50 * time.Millisecond
+	tests := []struct {
+		name      string
+		threshold int
+		steps     string // f fails, s succeeds, w waits out the cool-down
+		ready     bool
+		acquire   []bool
+	}{
+		{name: "closed", threshold: 2, steps: "", ready: true, acquire: []bool{true, true}},
+		{name: "below threshold", threshold: 2, steps: "f", ready: true, acquire: []bool{true, true}},
+		{name: "opens at threshold", threshold: 2, steps: "ff", ready: false, acquire: []bool{false}},
+		{name: "success resets the count", threshold: 2, steps: "fsf", ready: true, acquire: []bool{true, true}},
+		{name: "single trial after the cool-down", threshold: 2, steps: "ffw", ready: true, acquire: []bool{true, false, false}},
+		{name: "failed trial opens again", threshold: 2, steps: "ffwf", ready: false, acquire: []bool{false}},
+		{name: "successful trial closes", threshold: 2, steps: "ffws", ready: true, acquire: []bool{true, true}},
+		{name: "disabled", threshold: 0, steps: "fffff", ready: true, acquire: []bool{true, true}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			b := newBreaker(tt.threshold, cooldown)
+			for _, step := range tt.steps {
+				switch step {
+				case 'f':
+					b.Failure()
+				case 's':
+					b.Success()
+				case 'w':
+					time.Sleep(cooldown)
+				}
+			}
+			if b.Ready() != tt.ready {
+				t.Errorf("Ready() = %v, want %v", !tt.ready, tt.ready)
+			}
+			for i, want := range tt.acquire {
+				if got := b.TryAcquire(); got != want {
+					t.Errorf("TryAcquire() %d = %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBreakerFailureReportsOpening(t *testing.T) {
+	b := newBreaker(2, time.Minute)
+	for i, want := range []bool{false, true, false} {
+		if got := b.Failure(); got != want {
+			t.Errorf("Failure() %d = %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestBreakerConcurrentTrial(t *testing.T) {
+	const cooldown = 20 * time.Millisecond
+	b := newBreaker(1, cooldown)
+	b.Failure()
+	time.Sleep(cooldown)
+
+	acquired := atomic.Int32{}
+	wg := sync.WaitGroup{}
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if b.TryAcquire() {
+				acquired.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := acquired.Load(); n != 1 {
+		t.Errorf("%d requests got the trial, want 1", n)
+	}
+}
@@ -2,16 +2,27 @@ package chat
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"raychat/settings"
+	"raychat/transport"
+	"time"
 )
 
 const (
 	url = "https://backend.raycast.com/api/v1/ai/chat_completions"
 )
 
+var ErrUpstreamIdleTimeout = fmt.Errorf("%w: no data from raycast within the idle timeout", ErrUpstreamUnavailable)
+
 type RayChat struct {
 	Token string
+	// Transport sends the requests, the shared default transport if nil
+	Transport http.RoundTripper
 }
 
 func Cli(token string) *RayChat {
@@ -20,16 +31,20 @@ func Cli(token string) *RayChat {
 	}
 }
 
-func (r *RayChat) Chat(request RayChatRequest) (*http.Response, error) {
+// Chat sends request to raycast, the request and the stream are aborted once ctx
+// is done or raycast sends nothing for UPSTREAM_IDLE_TIMEOUT
+func (r *RayChat) Chat(ctx context.Context, request RayChatRequest) (*http.Response, error) {
 	rawReq, err := json.Marshal(request)
 	if err != nil {
 		return nil, err
 	}
 
-	client := &http.Client{}
+	ctx, cancel := context.WithCancelCause(ctx)
+	idle := newIdleTimer(settings.Get().UpstreamIdleTimeout, cancel)
 	payload := bytes.NewReader(rawReq)
-	req, err := http.NewRequest(http.MethodPost, url, payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, payload)
 	if err != nil {
+		cancel(nil)
 		return nil, err
 	}
 	req.Header.Add("Accept", "application/json")
@@ -38,10 +53,74 @@ func (r *RayChat) Chat(request RayChatRequest) (*http.Response, error) {
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("Authorization", "Bearer "+r.Token)
 
+	client := &http.Client{Transport: r.Transport}
+	if r.Transport == nil {
+		client.Transport = transport.Default()
+	}
 	res, err := client.Do(req)
-	if err != nil || res.StatusCode != http.StatusOK {
-		return res, err
+	if err != nil {
+		idle.Stop()
+		cancel(nil)
+		if cause := context.Cause(ctx); errors.Is(cause, ErrUpstreamIdleTimeout) {
+			return nil, cause
+		}
+		return nil, err
 	}
-
+	res.Body = &idleTimeoutBody{ReadCloser: res.Body, ctx: ctx, cancel: cancel, idle: idle}
 	return res, nil
-}
\ No newline at end of file
+}
+
+// idleTimer cancels the request once it is not reset for timeout, a zero
+// timeout disables it
+type idleTimer struct {
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func newIdleTimer(timeout time.Duration, cancel context.CancelCauseFunc) *idleTimer {
+	t := &idleTimer{timeout: timeout}
+	if timeout > 0 {
+		t.timer = time.AfterFunc(timeout, func() { cancel(ErrUpstreamIdleTimeout) })
+	}
+	return t
+}
+
+func (t *idleTimer) Reset() {
+	if t.timer != nil {
+		t.timer.Reset(t.timeout)
+	}
+}
+
+func (t *idleTimer) Stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+// idleTimeoutBody resets the idle timer on every read and reports the idle
+// timeout instead of the bare context error
+type idleTimeoutBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	idle   *idleTimer
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.idle.Reset()
+	}
+	if err != nil && err != io.EOF {
+		if cause := context.Cause(b.ctx); errors.Is(cause, ErrUpstreamIdleTimeout) {
+			err = cause
+		}
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.idle.Stop()
+	b.cancel(nil)
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,251 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/samber/lo"
+)
+
+// completionInstructions turn the chat model into a text completion model
+const completionInstructions = "You are a text completion engine. The user message is a text to continue. " +
+	"Reply with the continuation only, starting exactly where the text ends. " +
+	"Do not repeat the text, do not comment on it and do not use markdown unless the text does."
+
+// suffixInstructions asks for text fitting in front of suffix
+func suffixInstructions(suffix string) string {
+	if suffix == "" {
+		return ""
+	}
+	return "\nThe continuation is inserted right before the following suffix, make it fit in between:\n" + suffix
+}
+
+type CompletionRequest struct {
+	Model         string         `json:"model"`
+	Prompt        Prompt         `json:"prompt"`
+	Suffix        string         `json:"suffix"`
+	Stream        bool           `json:"stream"`
+	Temperature   float64        `json:"temperature"`
+	MaxTokens     int            `json:"max_tokens"`
+	Stop          StopSequences  `json:"stop"`
+	Echo          bool           `json:"echo"`
+	N             int            `json:"n"`
+	StreamOptions *StreamOptions `json:"stream_options"`
+}
+
+// Prompt is a single prompt or a list of prompts, every prompt gets its own choices
+type Prompt []string
+
+func (p *Prompt) UnmarshalJSON(data []byte) error {
+	var prompt string
+	if err := json.Unmarshal(data, &prompt); err == nil {
+		*p = Prompt{prompt}
+		return nil
+	}
+	var prompts []string
+	if err := json.Unmarshal(data, &prompts); err != nil {
+		return fmt.Errorf("prompt must be a string or an array of strings, token prompts are not supported")
+	}
+	*p = prompts
+	return nil
+}
+
+// ToRayChatRequests returns the raycast request of every prompt
+func (r CompletionRequest) ToRayChatRequests() ([]RayChatRequest, error) {
+	if len(r.Prompt) == 0 {
+		return nil, fmt.Errorf("%w: prompt is required", ErrInvalidRequest)
+	}
+	if r.Temperature == 0 {
+		r.Temperature = 1
+	}
+
+	model, provider, err := resolveModel(r.Model)
+	if err != nil {
+		return nil, err
+	}
+
+	instructions := completionInstructions + suffixInstructions(r.Suffix)
+	requests := []RayChatRequest{}
+	for _, prompt := range r.Prompt {
+		requests = append(requests, RayChatRequest{
+			Debug:                        false,
+			Locale:                       "en-CN",
+			Provider:                     provider,
+			Model:                        model,
+			Temperature:                  r.Temperature,
+			AdditionalSystemInstructions: instructions,
+			Messages: []RayChatMessage{
+				{Author: "user", Content: Content{Text: prompt}},
+			},
+		})
+	}
+	return requests, nil
+}
+
+type CompletionChoice struct {
+	Text         string  `json:"text"`
+	Index        int     `json:"index"`
+	Logprobs     any     `json:"logprobs"`
+	FinishReason *string `json:"finish_reason"`
+}
+
+type CompletionResponse struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int                `json:"created"`
+	Model   string             `json:"model"`
+	Choices []CompletionChoice `json:"choices"`
+	Usage   *Usage             `json:"usage,omitempty"`
+}
+
+// CompletionsEndpoint serves the legacy text completion api by sending every
+// prompt as a single user message
+func CompletionsEndpoint(c *gin.Context) {
+	originReq := &CompletionRequest{}
+	if err := c.Copy().ShouldBindJSON(originReq); err != nil {
+		abortWithError(c, fmt.Errorf("%w: %v", ErrInvalidRequest, err))
+		return
+	}
+	n := choiceCount(originReq.N)
+	rayChatReqs, err := originReq.ToRayChatRequests()
+	if err == nil {
+		err = checkChoices(originReq.N, n*len(rayChatReqs))
+	}
+	if err == nil {
+		err = checkModelAllowed(c, originReq.Model, rayChatReqs[0].Model)
+	}
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+	// choice i answers prompt i / n
+	requests := []RayChatRequest{}
+	for i := 0; i < n*len(rayChatReqs); i++ {
+		requests = append(requests, rayChatReqs[i/n])
+	}
+	first, sources, err := sendChoices(c, originReq.Model, originReq.Stream, nil, requests)
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	// all prompts are answered by the model that answered first
+	for i := range rayChatReqs {
+		rayChatReqs[i].Model, rayChatReqs[i].Provider = first.Model, first.Provider
+	}
+	promptTokens := 0
+	for _, request := range rayChatReqs {
+		promptTokens += request.PromptTokens()
+	}
+	prompts := []string{}
+	for i := range requests {
+		prompts = append(prompts, originReq.Prompt[i/n])
+	}
+
+	switch originReq.Stream {
+	case true:
+		streamCompletions(c, originReq, first.Model, prompts, promptTokens, sources)
+	default:
+		plainCompletions(c, originReq, first.Model, prompts, promptTokens, sources)
+	}
+}
+
+// finishReason is the finish reason of the limiter, "stop" if no limit was hit
+func finishReason(limiter *outputLimiter) *string {
+	if reason := limiter.FinishReason(); reason != nil {
+		return reason
+	}
+	return lo.ToPtr("stop")
+}
+
+func plainCompletions(c *gin.Context, req *CompletionRequest, model string, prompts []string, promptTokens int, sources []choiceSource) {
+	choices := make([]CompletionChoice, len(sources))
+	completions := make([]string, len(sources))
+	err := eachChoice(c.Request.Context(), sources, func(ctx context.Context, i int, source choiceSource) error {
+		limiter := newOutputLimiter(model, req.Stop, req.MaxTokens)
+		text := strings.Builder{}
+		err := readText(ctx, source, limiter, func(chunk string) error {
+			text.WriteString(chunk)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		completions[i] = text.String()
+		choices[i] = CompletionChoice{
+			Text:         completions[i],
+			Index:        i,
+			FinishReason: finishReason(limiter),
+		}
+		if req.Echo {
+			choices[i].Text = prompts[i] + choices[i].Text
+		}
+		return nil
+	})
+	if err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	usage := recordUsage(c, model, promptTokens, completions)
+	c.JSON(http.StatusOK, CompletionResponse{
+		ID:      "cmpl-" + generateRandomString(29),
+		Object:  "text_completion",
+		Created: int(time.Now().Unix()),
+		Model:   model,
+		Choices: choices,
+		Usage:   &usage,
+	})
+}
+
+func streamCompletions(c *gin.Context, req *CompletionRequest, model string, prompts []string, promptTokens int, sources []choiceSource) {
+	if err := beginStream(c, sources, "text/event-stream"); err != nil {
+		abortWithError(c, err)
+		return
+	}
+
+	defer func() {
+		c.Writer.WriteString("data: [DONE]\n\n")
+		c.Writer.Flush()
+	}()
+
+	w := newCompletionWriter(c, model)
+	defer countStream(c, model)()
+
+	completions := make([]string, len(sources))
+	err := eachChoice(c.Request.Context(), sources, func(ctx context.Context, i int, source choiceSource) error {
+		limiter := newOutputLimiter(model, req.Stop, req.MaxTokens)
+		completion := strings.Builder{}
+		// the prompt goes out with the first text of the choice
+		echo := ""
+		if req.Echo {
+			echo = prompts[i]
+		}
+		err := readText(ctx, source, limiter, func(text string) error {
+			completion.WriteString(text)
+			text, echo = echo+text, ""
+			return w.WriteText(i, text, nil)
+		})
+		completions[i] = completion.String()
+		if err != nil {
+			return err
+		}
+		return w.WriteText(i, echo, finishReason(limiter))
+	})
+
+	usage := recordUsage(c, model, promptTokens, completions)
+	if streamFailed(c, err, func(err error) {
+		_, errResp := NewErrorResponse(err)
+		c.Writer.WriteString(errResp.ToEventString() + "\n\n")
+	}) {
+		return
+	}
+	if req.StreamOptions != nil && req.StreamOptions.IncludeUsage {
+		w.WriteUsage(usage)
+	}
+}
@@ -1,95 +1,445 @@
 package chat
 
 import (
-	"bufio"
-	"io"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"raychat/metrics"
+	"raychat/stats"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/sirupsen/logrus"
+	"github.com/samber/lo"
 )
 
 func ChatEndpoint(c *gin.Context) {
 	originReq := &OpenAIRequest{}
 	if err := c.Copy().ShouldBindJSON(originReq); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		abortWithError(c, fmt.Errorf("%w: %v", ErrInvalidRequest, err))
 		return
 	}
-	r, err := Cli(getToken()).Chat(originReq.ToRayChatRequest(getAuthInstance()))
-	if err != nil || r.StatusCode != http.StatusOK {
-		data, err := io.ReadAll(r.Body)
-		logrus.WithError(err).Errorf("request to raycast error, request: %+v, body: %+v", r, string(data))
-		c.JSON(http.StatusBadRequest, gin.H{"error": "request to raycast error", "code": 400})
+	rayChatReq, sources, err := openChoices(c, originReq)
+	if err != nil {
+		abortWithError(c, err)
 		return
 	}
+
 	switch originReq.Stream {
 	case true:
-		streamResp(c, originReq, r)
+		streamResp(c, originReq, rayChatReq, sources)
 	default:
-		plainResp(c, originReq, r)
+		plainResp(c, originReq, rayChatReq, sources)
+	}
+}
+
+// openChoices checks req and the model allowlist, loads the attachments and
+// sends the n choices of req with sendChoices
+func openChoices(c *gin.Context, req *OpenAIRequest) (RayChatRequest, []choiceSource, error) {
+	validator, err := newOutputValidator(*req)
+	if err == nil {
+		err = checkChoices(req.N, req.GetN())
+	}
+	if err != nil {
+		return RayChatRequest{}, nil, err
+	}
+	rayChatReq, err := req.ToRayChatRequest()
+	if err == nil {
+		err = checkModelAllowed(c, req.Model, rayChatReq.Model)
 	}
+	if err == nil {
+		err = rayChatReq.loadAttachments(c.Request.Context())
+	}
+	if err != nil {
+		return RayChatRequest{}, nil, err
+	}
+	requests := []RayChatRequest{}
+	for i := 0; i < req.GetN(); i++ {
+		requests = append(requests, rayChatReq)
+	}
+	return sendChoices(c, req.Model, req.Stream, validator, requests)
 }
 
-func plainResp(c *gin.Context, req *OpenAIRequest, resp *http.Response) {
-	defer resp.Body.Close()
+// sendChoices sends the first of requests along the fallback chain of the
+// requested model and enforces the response format of validator, which may be
+// nil, on the answer. It returns the request that was answered and the sources
+// of all choices, the others are sent with the model that answered. Every
+// source must be read, the first one holds the account of the answer.
+func sendChoices(c *gin.Context, requested string, stream bool, validator *outputValidator, requests []RayChatRequest) (RayChatRequest, []choiceSource, error) {
+	st := stats.FromContext(c)
+	st.Stream = stream
+	chain := fallbackChain(c, requested, requests[0])
+	r, account, rayChatReq, err := requestRaycastChain(c.Request.Context(), chain, st)
+	if err != nil {
+		return RayChatRequest{}, nil, err
+	}
+	if validator != nil {
+		r, err = validator.Enforce(c.Request.Context(), rayChatReq, r, st)
+		if err != nil {
+			account.Release()
+			return RayChatRequest{}, nil, err
+		}
+	}
+	c.Header(modelHeader, rayChatReq.Model)
 
-	model, _ := req.GetRequestModel(getAuthInstance())
+	others := []RayChatRequest{}
+	for _, request := range requests[1:] {
+		request.Model, request.Provider = rayChatReq.Model, rayChatReq.Provider
+		others = append(others, request)
+	}
+	return rayChatReq, choiceSources(r, account, others, validator.open(), st), nil
+}
 
-	rayChatResps := *new(RayChatStreamResponses)
-	scanner := bufio.NewScanner(resp.Body)
-	for scanner.Scan() {
-		event := scanner.Text()
-		if len(event) == 0 {
-			continue
+// beginStream sets the headers of a stream of contentType, it fails if the
+// writer can not stream and closes the first choice, the only one open yet
+func beginStream(c *gin.Context, sources []choiceSource, contentType string) error {
+	if _, ok := c.Writer.(http.Flusher); !ok {
+		if _, done, err := sources[0](c.Request.Context()); err == nil {
+			done()
 		}
-		rayChatResp := RayChatStreamResponse{}.FromEventString(event)
-		rayChatResps = append(rayChatResps, rayChatResp)
+		return fmt.Errorf("server does not support streaming")
+	}
+	c.Writer.Header().Set("Content-Type", contentType)
+	if contentType == "text/event-stream" {
+		c.Writer.Header().Set("Cache-Control", "no-cache")
+		c.Writer.Header().Set("Connection", "keep-alive")
+	}
+	c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
+	return nil
+}
+
+// countStream counts a stream of model as in flight until the returned func is called
+func countStream(c *gin.Context, model string) func() {
+	inflight := metrics.InflightStreams.WithLabelValues(metrics.ModelLabel(model), stats.FromContext(c).Account)
+	inflight.Inc()
+	return inflight.Dec
+}
+
+// streamFailed reports whether a stream ended with err, the client is told
+// with writeError unless it disconnected
+func streamFailed(c *gin.Context, err error, writeError func(err error)) bool {
+	st := stats.FromContext(c)
+	if errors.Is(err, context.Canceled) {
+		Logger().WithField("request_id", st.RequestID).Info("client disconnected, stream aborted")
+		return true
 	}
-	if scanner.Err() != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": scanner.Err().Error()})
+	if err != nil {
+		Logger().WithField("request_id", st.RequestID).WithError(err).Error("stream response error")
+		writeError(err)
+		return true
+	}
+	return false
+}
+
+// recordUsage counts the tokens of the completions of all choices and records
+// them in the stats of the request
+func recordUsage(c *gin.Context, model string, promptTokens int, completions []string) Usage {
+	completionTokens := 0
+	for _, completion := range completions {
+		completionTokens += countTokens(model, completion)
+	}
+	usage := newUsage(promptTokens, completionTokens)
+	st := stats.FromContext(c)
+	st.PromptTokens, st.CompletionTokens = usage.PromptTokens, usage.CompletionTokens
+	st.Completion = joinCompletions(completions)
+	return usage
+}
+
+// readText reads the answer of source through limiter and calls fn with every
+// piece of text that may be sent
+func readText(ctx context.Context, source choiceSource, limiter *outputLimiter, fn func(text string) error) error {
+	resp, done, err := source(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+	err = readEvents(resp.Body, func(rayChatResp RayChatStreamResponse) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if text := limiter.Write(rayChatResp.Text); len(text) > 0 {
+			if err := fn(text); err != nil {
+				return err
+			}
+		}
+		if limiter.Done() {
+			return errLimitReached
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if text := limiter.Close(); len(text) > 0 {
+		return fn(text)
+	}
+	return nil
+}
+
+// plainResp reads all choices in parallel and answers them as one response
+func plainResp(c *gin.Context, req *OpenAIRequest, rayChatReq RayChatRequest, sources []choiceSource) {
+	resps := make([]OpenAIResponse, len(sources))
+	err := eachChoice(c.Request.Context(), sources, func(ctx context.Context, i int, source choiceSource) (err error) {
+		resps[i], err = readChoice(ctx, req, rayChatReq, source)
+		return err
+	})
+	if err != nil {
+		abortWithError(c, err)
 		return
 	}
-	openaiResp := rayChatResps.ToOpenAIResponse(model)
+
+	openaiResp := resps[0]
+	completions := []string{}
+	completionTokens := 0
+	openaiResp.Choices = []Choices{}
+	for i, resp := range resps {
+		choice := resp.Choices[0]
+		choice.Index = i
+		openaiResp.Choices = append(openaiResp.Choices, choice)
+		completions = append(completions, choice.Message.Content)
+		completionTokens += resp.Usage.CompletionTokens
+	}
+	openaiResp.Usage = newUsage(rayChatReq.PromptTokens(), completionTokens)
+	st := stats.FromContext(c)
+	st.PromptTokens, st.CompletionTokens = openaiResp.Usage.PromptTokens, openaiResp.Usage.CompletionTokens
+	st.Completion = joinCompletions(completions)
 	c.JSON(http.StatusOK, openaiResp)
 }
 
-func streamResp(c *gin.Context, req *OpenAIRequest, resp *http.Response) {
-	c.Writer.Header().Set("Content-Type", "text/event-stream")
-	c.Writer.Header().Set("Cache-Control", "no-cache")
-	c.Writer.Header().Set("Connection", "keep-alive")
-	c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
+// readChoice reads the answer of a single choice
+func readChoice(ctx context.Context, req *OpenAIRequest, rayChatReq RayChatRequest, source choiceSource) (OpenAIResponse, error) {
+	resp, done, err := source(ctx)
+	if err != nil {
+		return OpenAIResponse{}, err
+	}
+	defer done()
+
+	model := rayChatReq.Model
+
+	limiter := newOutputLimiter(model, req.Stop, req.GetMaxTokens())
+	rayChatResps := *new(RayChatStreamResponses)
+	err = readEvents(resp.Body, func(rayChatResp RayChatStreamResponse) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rayChatResp.Text = limiter.Write(rayChatResp.Text)
+		rayChatResps = append(rayChatResps, rayChatResp)
+		if limiter.Done() {
+			return errLimitReached
+		}
+		return nil
+	})
+	if err != nil {
+		return OpenAIResponse{}, err
+	}
+	rayChatResps = append(rayChatResps, RayChatStreamResponse{Text: limiter.Close()})
+	openaiResp := rayChatResps.ToOpenAIResponse(model, rayChatReq.PromptTokens())
+	if finishReason := limiter.FinishReason(); finishReason != nil {
+		openaiResp.Choices[0].FinishReason = finishReason
+	}
+	if req.UseTools() {
+		content, calls := parseToolCalls(openaiResp.Choices[0].Message.Content)
+		if len(calls) > 0 {
+			openaiResp.Choices[0].Message.Content = content
+			msg, finishReason := req.toolCallsMessage(openaiResp.Choices[0].Message, calls)
+			openaiResp.Choices[0].Message = msg
+			openaiResp.Choices[0].FinishReason = lo.ToPtr(finishReason)
+		}
+	}
+	return openaiResp, nil
+}
+
+// chunkWriter writes the chat.completion.chunk events of a single stream, or
+// the text_completion ones of the legacy completions. The choices of the
+// stream may write concurrently.
+type chunkWriter struct {
+	mu      sync.Mutex
+	c       *gin.Context
+	id      string
+	object  string
+	created int
+	model   string
+}
+
+func newChunkWriter(c *gin.Context, model string) *chunkWriter {
+	return &chunkWriter{
+		c:       c,
+		id:      "chatcmpl-" + generateRandomString(29),
+		object:  "chat.completion.chunk",
+		created: int(time.Now().Unix()),
+		model:   model,
+	}
+}
+
+func newCompletionWriter(c *gin.Context, model string) *chunkWriter {
+	return &chunkWriter{
+		c:       c,
+		id:      "cmpl-" + generateRandomString(29),
+		object:  "text_completion",
+		created: int(time.Now().Unix()),
+		model:   model,
+	}
+}
+
+func (w *chunkWriter) Write(index int, delta Delta, finishReason *string) error {
+	return w.write(OpenAIStreamResponse{
+		ID:      w.id,
+		Object:  w.object,
+		Created: w.created,
+		Model:   w.model,
+		Choices: []StreamChoices{
+			{
+				Index:        index,
+				Delta:        delta,
+				FinishReason: finishReason,
+			},
+		},
+	})
+}
+
+// WriteText writes text of a legacy completion choice
+func (w *chunkWriter) WriteText(index int, text string, finishReason *string) error {
+	return w.write(CompletionResponse{
+		ID:      w.id,
+		Object:  w.object,
+		Created: w.created,
+		Model:   w.model,
+		Choices: []CompletionChoice{
+			{Text: text, Index: index, FinishReason: finishReason},
+		},
+	})
+}
 
-	_, ok := c.Writer.(http.Flusher)
-	if !ok {
-		logrus.Panic("server not support")
+// WriteUsage writes the final chunk carrying the usage of the whole stream and no choices
+func (w *chunkWriter) WriteUsage(usage Usage) error {
+	return w.write(OpenAIStreamResponse{
+		ID:      w.id,
+		Object:  w.object,
+		Created: w.created,
+		Model:   w.model,
+		Choices: []StreamChoices{},
+		Usage:   &usage,
+	})
+}
+
+func (w *chunkWriter) write(chunk any) error {
+	data, err := json.Marshal(chunk)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, err := w.c.Writer.WriteString("data: " + string(data) + "\n\n"); err != nil {
+		return err
 	}
+	w.c.Writer.Flush()
+	return nil
+}
+
+// streamResp streams all choices at once, their chunks are told apart by index
+func streamResp(c *gin.Context, req *OpenAIRequest, rayChatReq RayChatRequest, sources []choiceSource) {
+	if err := beginStream(c, sources, "text/event-stream"); err != nil {
+		abortWithError(c, err)
+		return
+	}
+
 	defer func() {
 		c.Writer.WriteString("data: [DONE]\n\n")
 		c.Writer.Flush()
-		resp.Body.Close()
 	}()
 
-	model, _ := req.GetRequestModel(getAuthInstance())
+	model := rayChatReq.Model
+	w := newChunkWriter(c, model)
+	defer countStream(c, model)()
+
+	completions := make([]string, len(sources))
+	err := eachChoice(c.Request.Context(), sources, func(ctx context.Context, i int, source choiceSource) (err error) {
+		completions[i], err = streamChoice(ctx, req, model, w, i, source)
+		return err
+	})
+
+	usage := recordUsage(c, model, rayChatReq.PromptTokens(), completions)
+	if streamFailed(c, err, func(err error) {
+		_, errResp := NewErrorResponse(err)
+		c.Writer.WriteString(errResp.ToEventString() + "\n\n")
+	}) {
+		return
+	}
+	if req.IncludeUsage() {
+		w.WriteUsage(usage)
+	}
+}
+
+// streamChoice streams a single choice with w and returns its completion
+func streamChoice(ctx context.Context, req *OpenAIRequest, model string, w *chunkWriter, index int, source choiceSource) (string, error) {
+	resp, done, err := source(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer done()
+
+	limiter := newOutputLimiter(model, req.Stop, req.GetMaxTokens())
+	var tools *toolCallStream
+	if req.UseTools() {
+		tools = &toolCallStream{}
+	}
+	var finishReason *string
+	completion := strings.Builder{}
 
-	scanner := bufio.NewScanner(resp.Body)
-	for scanner.Scan() {
-		event := scanner.Text()
-		if len(event) == 0 {
-			c.Writer.WriteString("\n")
-			c.Writer.Flush()
-			continue
+	writeText := func(text string) error {
+		completion.WriteString(text)
+		if tools != nil {
+			text = tools.Write(text)
 		}
-		rayChatResp := RayChatStreamResponse{}.FromEventString(event)
-		openAIResp := rayChatResp.ToOpenAISteamResponse(model)
-		eventResp := openAIResp.ToEventString()
-		_, err := c.Writer.WriteString(eventResp + "\n")
-		if err != nil {
-			c.Writer.WriteString("data: {\"finish_reason\":\"stop\"}" + "\n")
-			return
+		if len(text) == 0 {
+			return nil
 		}
-		c.Writer.Flush()
+		return w.Write(index, Delta{Content: text}, nil)
 	}
-	if scanner.Err() != nil {
-		return
+
+	err = w.Write(index, Delta{Role: "assistant"}, nil)
+	if err == nil {
+		err = readEvents(resp.Body, func(rayChatResp RayChatStreamResponse) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if rayChatResp.FinishReason != nil {
+				finishReason = rayChatResp.FinishReason
+			}
+			if err := writeText(limiter.Write(rayChatResp.Text)); err != nil {
+				return err
+			}
+			if limiter.Done() {
+				return errLimitReached
+			}
+			return nil
+		})
+	}
+	if err == nil {
+		err = writeText(limiter.Close())
+	}
+	if limiter.FinishReason() != nil {
+		finishReason = limiter.FinishReason()
+	}
+	if err == nil && tools != nil {
+		content, calls := tools.Close()
+		if len(content) != 0 {
+			err = w.Write(index, Delta{Content: content}, nil)
+		}
+		if err == nil && len(calls) > 0 {
+			delta, reason := req.toolCallsDelta(calls)
+			finishReason = lo.ToPtr(reason)
+			err = w.Write(index, delta, nil)
+		}
+	}
+	if err != nil {
+		return completion.String(), err
+	}
+	if finishReason == nil {
+		finishReason = lo.ToPtr("stop")
 	}
+	return completion.String(), w.Write(index, Delta{}, finishReason)
 }
@@ -0,0 +1,103 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"raychat/auth"
+	"raychat/keystore"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	ErrUpstreamAuth        = auth.ErrUpstreamAuth
+	ErrUpstreamUnavailable = auth.ErrUpstreamUnavailable
+	ErrBadUpstreamPayload  = auth.ErrBadUpstreamPayload
+	ErrQuota               = errors.New("raycast quota exceeded")
+	ErrInvalidRequest      = errors.New("invalid request")
+	ErrModelNotAllowed     = errors.New("model not allowed")
+	ErrUpstreamRejected    = fmt.Errorf("%w: raycast rejected the request", ErrInvalidRequest)
+)
+
+type ErrorDetail struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    string  `json:"code"`
+}
+
+// ErrorResponse is the OpenAI error envelope
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+func (e ErrorResponse) ToEventString() string {
+	bytesRsp, err := json.Marshal(e)
+	if err != nil {
+		return `data: {"error":{"message":"internal error","type":"server_error","param":null,"code":"internal_error"}}`
+	}
+	return "data: " + string(bytesRsp)
+}
+
+// NewError returns the OpenAI error envelope of errors without a typed error,
+// like the auth, rate limit and admin api errors
+func NewError(message, errType, code string) ErrorResponse {
+	return ErrorResponse{Error: ErrorDetail{
+		Message: message,
+		Type:    errType,
+		Code:    code,
+	}}
+}
+
+// NewErrorResponse maps err to its http status and OpenAI error envelope
+func NewErrorResponse(err error) (int, ErrorResponse) {
+	status, errType, code := http.StatusInternalServerError, "server_error", "internal_error"
+	switch {
+	case errors.Is(err, ErrInvalidRequest):
+		status, errType, code = http.StatusBadRequest, "invalid_request_error", "invalid_request"
+	case errors.Is(err, ErrModelNotFound):
+		status, errType, code = http.StatusNotFound, "invalid_request_error", "model_not_found"
+	case errors.Is(err, ErrModelNotAllowed):
+		status, errType, code = http.StatusForbidden, "invalid_request_error", "model_not_allowed"
+	case errors.Is(err, ErrQuota):
+		status, errType, code = http.StatusTooManyRequests, "insufficient_quota", "insufficient_quota"
+	case errors.Is(err, ErrUpstreamAuth):
+		status, errType, code = http.StatusBadGateway, "upstream_error", "upstream_auth_failed"
+	case errors.Is(err, ErrBadUpstreamPayload):
+		status, errType, code = http.StatusBadGateway, "upstream_error", "bad_upstream_payload"
+	case errors.Is(err, ErrUpstreamUnavailable), errors.Is(err, ErrNoAccount):
+		status, errType, code = http.StatusServiceUnavailable, "upstream_error", "upstream_unavailable"
+	}
+	return status, NewError(err.Error(), errType, code)
+}
+
+// checkModelAllowed checks the allowlist of the api key, either the requested
+// model or the raycast model it resolved to must be allowed
+func checkModelAllowed(c *gin.Context, requested, model string) error {
+	key, ok := keystore.FromContext(c)
+	if !ok || key.AllowsModel(requested) || key.AllowsModel(model) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s is not allowed for this api key", ErrModelNotAllowed, requested)
+}
+
+func abortWithError(c *gin.Context, err error) {
+	status, resp := NewErrorResponse(err)
+	c.AbortWithStatusJSON(status, resp)
+}
+
+// upstreamStatusError turns a non 200 raycast response into a typed error
+func upstreamStatusError(statusCode int, body []byte) error {
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return fmt.Errorf("%w: status %d: %s", ErrUpstreamAuth, statusCode, body)
+	case statusCode == http.StatusPaymentRequired || statusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("%w: status %d: %s", ErrQuota, statusCode, body)
+	case statusCode >= 500:
+		return fmt.Errorf("%w: status %d: %s", ErrUpstreamUnavailable, statusCode, body)
+	default:
+		return fmt.Errorf("%w with status %d: %s", ErrUpstreamRejected, statusCode, body)
+	}
+}
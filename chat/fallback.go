@@ -0,0 +1,71 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"raychat/settings"
+	"raychat/stats"
+
+	"github.com/gin-gonic/gin"
+)
+
+// modelHeader tells the client which raycast model answered
+const modelHeader = "X-Raychat-Model"
+
+// fallbackChain returns request followed by a copy of it for every model in
+// the MODEL_FALLBACKS chain of the requested or the resolved model. Models the
+// api key may not use or that can not be resolved are left out.
+func fallbackChain(c *gin.Context, requested string, request RayChatRequest) []RayChatRequest {
+	fallbacks := settings.Get().ModelFallbacks
+	models, ok := fallbacks[requested]
+	if !ok {
+		models = fallbacks[request.Model]
+	}
+	chain := []RayChatRequest{request}
+	seen := map[string]bool{request.Model: true}
+	for _, name := range models {
+		model, provider, err := resolveModel(name)
+		if err != nil || seen[model] || checkModelAllowed(c, name, model) != nil {
+			continue
+		}
+		if request.hasAttachments() && !supportsVision(model) {
+			continue
+		}
+		seen[model] = true
+		fallback := request
+		fallback.Model, fallback.Provider = model, provider
+		chain = append(chain, fallback)
+	}
+	return chain
+}
+
+// requestRaycastChain sends the requests of chain in order until one is
+// answered, the next model is only tried on errors specific to the model and
+// nothing has been streamed at that point. It returns the request that was
+// answered with the response.
+func requestRaycastChain(ctx context.Context, chain []RayChatRequest, st *stats.Stats) (*http.Response, *Account, RayChatRequest, error) {
+	var err error
+	for i, request := range chain {
+		var r *http.Response
+		var account *Account
+		r, account, err = requestRaycast(ctx, request, st)
+		if err == nil {
+			return r, account, request, nil
+		}
+		if !modelSpecific(err) || i == len(chain)-1 {
+			break
+		}
+		Logger().WithField("request_id", st.RequestID).WithError(err).Warnf("model %s failed, fall back to %s", request.Model, chain[i+1].Model)
+	}
+	return nil, nil, RayChatRequest{}, err
+}
+
+// modelSpecific reports whether another model may succeed where err failed.
+// connection errors, timeouts, open circuits and 5xx hit every model alike, they
+// already used up the retries and are not worth another round per model.
+func modelSpecific(err error) bool {
+	return errors.Is(err, ErrNoAccount) ||
+		errors.Is(err, ErrQuota) ||
+		errors.Is(err, ErrUpstreamRejected)
+}
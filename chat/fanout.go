@@ -0,0 +1,115 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"raychat/settings"
+	"raychat/stats"
+	"strings"
+	"sync"
+)
+
+// choiceSource opens the raycast response of one of the n choices of a
+// request, done is called once the response is read
+type choiceSource func(ctx context.Context) (resp *http.Response, done func(), err error)
+
+// GetN returns how many choices the client asked for
+func (r OpenAIRequest) GetN() int {
+	return choiceCount(r.N)
+}
+
+func choiceCount(n int) int {
+	if n <= 0 {
+		return 1
+	}
+	return n
+}
+
+// checkChoices rejects a negative n and more than MAX_CHOICES choices in total
+func checkChoices(n, total int) error {
+	if n < 0 {
+		return fmt.Errorf("%w: n must be positive", ErrInvalidRequest)
+	}
+	if limit := settings.Get().MaxChoices; total > limit {
+		return fmt.Errorf("%w: no more than %d choices may be asked for", ErrInvalidRequest, limit)
+	}
+	return nil
+}
+
+// openFunc sends a raycast request like requestRaycast
+type openFunc func(ctx context.Context, request RayChatRequest, st *stats.Stats) (*http.Response, *Account, error)
+
+// choiceSources returns the sources of all choices, the first one is resp
+// answered by account and the others send requests with open. They are sent
+// in parallel, Pick bounds them to FANOUT_PER_ACCOUNT on every account.
+func choiceSources(resp *http.Response, account *Account, requests []RayChatRequest, open openFunc, st *stats.Stats) []choiceSource {
+	sources := []choiceSource{func(context.Context) (*http.Response, func(), error) {
+		return resp, func() {
+			resp.Body.Close()
+			account.Release()
+		}, nil
+	}}
+	for _, request := range requests {
+		request := request
+		sources = append(sources, func(ctx context.Context) (*http.Response, func(), error) {
+			ctx, lease := withFanout(ctx, getPool())
+			// the stats of the request are those of the first choice
+			resp, account, err := open(ctx, request, &stats.Stats{RequestID: st.RequestID})
+			if err != nil {
+				lease.release()
+				return nil, nil, err
+			}
+			return resp, func() {
+				resp.Body.Close()
+				account.Release()
+				lease.release()
+			}, nil
+		})
+	}
+	return sources
+}
+
+// eachChoice calls fn for every source in parallel, once one fails the others
+// are canceled
+func eachChoice(ctx context.Context, sources []choiceSource, fn func(ctx context.Context, index int, source choiceSource) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make([]error, len(sources))
+	wg := sync.WaitGroup{}
+	for i, source := range sources {
+		wg.Add(1)
+		go func(i int, source choiceSource) {
+			defer wg.Done()
+			if errs[i] = fn(ctx, i, source); errs[i] != nil {
+				cancel()
+			}
+		}(i, source)
+	}
+	wg.Wait()
+	return firstError(errs)
+}
+
+// firstError returns the error that made the choices fail, the others were
+// canceled because of it
+func firstError(errs []error) error {
+	var canceled error
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, context.Canceled) {
+			return err
+		}
+		if canceled == nil {
+			canceled = err
+		}
+	}
+	return canceled
+}
+
+// joinCompletions keeps the text of every choice for the audit log
+func joinCompletions(completions []string) string {
+	return strings.Join(completions, "\n\n")
+}
@@ -0,0 +1,448 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/samber/lo"
+)
+
+type GeminiBlob struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"`
+}
+
+type GeminiFileData struct {
+	MimeType string `json:"mimeType"`
+	FileURI  string `json:"fileUri"`
+}
+
+type GeminiPart struct {
+	Text       string          `json:"text"`
+	InlineData *GeminiBlob     `json:"inlineData,omitempty"`
+	FileData   *GeminiFileData `json:"fileData,omitempty"`
+	// FunctionCall and FunctionResponse are only read to reject them
+	FunctionCall     json.RawMessage `json:"functionCall,omitempty"`
+	FunctionResponse json.RawMessage `json:"functionResponse,omitempty"`
+}
+
+type GeminiContent struct {
+	Role  string       `json:"role,omitempty"`
+	Parts []GeminiPart `json:"parts"`
+}
+
+type GeminiGenerationConfig struct {
+	Temperature        float64         `json:"temperature"`
+	MaxOutputTokens    int             `json:"maxOutputTokens"`
+	StopSequences      []string        `json:"stopSequences"`
+	CandidateCount     int             `json:"candidateCount"`
+	ResponseMimeType   string          `json:"responseMimeType"`
+	ResponseSchema     json.RawMessage `json:"responseSchema"`
+	ResponseJSONSchema json.RawMessage `json:"responseJsonSchema"`
+}
+
+type GeminiRequest struct {
+	Contents          []GeminiContent        `json:"contents"`
+	SystemInstruction *GeminiContent         `json:"systemInstruction"`
+	GenerationConfig  GeminiGenerationConfig `json:"generationConfig"`
+}
+
+// the gemini api takes proto json, the fields may be snake_case as well
+
+func (r *GeminiRequest) UnmarshalJSON(data []byte) error {
+	type plain GeminiRequest
+	return unmarshalProto(data, (*plain)(r))
+}
+
+func (c *GeminiContent) UnmarshalJSON(data []byte) error {
+	type plain GeminiContent
+	return unmarshalProto(data, (*plain)(c))
+}
+
+func (p *GeminiPart) UnmarshalJSON(data []byte) error {
+	type plain GeminiPart
+	return unmarshalProto(data, (*plain)(p))
+}
+
+func (b *GeminiBlob) UnmarshalJSON(data []byte) error {
+	type plain GeminiBlob
+	return unmarshalProto(data, (*plain)(b))
+}
+
+func (f *GeminiFileData) UnmarshalJSON(data []byte) error {
+	type plain GeminiFileData
+	return unmarshalProto(data, (*plain)(f))
+}
+
+func (g *GeminiGenerationConfig) UnmarshalJSON(data []byte) error {
+	type plain GeminiGenerationConfig
+	return unmarshalProto(data, (*plain)(g))
+}
+
+// unmarshalProto decodes the json object data into v with its snake_case
+// field names turned into lowerCamelCase, nested objects are left alone
+func unmarshalProto(data []byte, v any) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	camel := map[string]json.RawMessage{}
+	for name, value := range fields {
+		camel[lowerCamel(name)] = value
+	}
+	data, err := json.Marshal(camel)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func lowerCamel(name string) string {
+	words := strings.Split(name, "_")
+	for i := 1; i < len(words); i++ {
+		if runes := []rune(words[i]); len(runes) > 0 {
+			runes[0] = unicode.ToUpper(runes[0])
+			words[i] = string(runes)
+		}
+	}
+	return strings.Join(words, "")
+}
+
+// Text joins the text parts and returns the images as urls
+func (c GeminiContent) Text() (string, []string, error) {
+	texts := []string{}
+	images := []string{}
+	for i, part := range c.Parts {
+		switch {
+		case part.InlineData != nil:
+			images = append(images, "data:"+part.InlineData.MimeType+";base64,"+part.InlineData.Data)
+		case part.FileData != nil:
+			if !strings.HasPrefix(part.FileData.MimeType, "image/") {
+				return "", nil, fmt.Errorf("%w: file part %d is not an image", ErrInvalidRequest, i)
+			}
+			images = append(images, part.FileData.FileURI)
+		case len(part.FunctionCall) > 0 || len(part.FunctionResponse) > 0:
+			return "", nil, fmt.Errorf("%w: function calling is not supported", ErrInvalidRequest)
+		default:
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n"), images, nil
+}
+
+// geminiSchema turns the openapi schema of responseSchema into json schema,
+// gemini spells the types in upper case and marks optional values nullable
+func geminiSchema(schema any) any {
+	switch s := schema.(type) {
+	case map[string]any:
+		converted := map[string]any{}
+		for key, value := range s {
+			converted[key] = geminiSchema(value)
+		}
+		if t, ok := s["type"].(string); ok {
+			converted["type"] = strings.ToLower(t)
+		}
+		if nullable, ok := s["nullable"].(bool); ok {
+			if t, isString := converted["type"].(string); isString && nullable {
+				converted["type"] = []string{t, "null"}
+			}
+			delete(converted, "nullable")
+		}
+		return converted
+	case []any:
+		return lo.Map(s, func(item any, _ int) any { return geminiSchema(item) })
+	}
+	return schema
+}
+
+func (g GeminiGenerationConfig) responseFormat() (*ResponseFormat, error) {
+	switch {
+	case len(g.ResponseJSONSchema) > 0:
+		return &ResponseFormat{Type: "json_schema", JSONSchema: &JSONSchemaFormat{Schema: g.ResponseJSONSchema}}, nil
+	case len(g.ResponseSchema) > 0:
+		var schema any
+		if err := json.Unmarshal(g.ResponseSchema, &schema); err != nil {
+			return nil, fmt.Errorf("%w: responseSchema: %v", ErrInvalidRequest, err)
+		}
+		data, err := json.Marshal(geminiSchema(schema))
+		if err != nil {
+			return nil, err
+		}
+		return &ResponseFormat{Type: "json_schema", JSONSchema: &JSONSchemaFormat{Schema: data}}, nil
+	case g.ResponseMimeType == "application/json":
+		return &ResponseFormat{Type: "json_object"}, nil
+	}
+	return nil, nil
+}
+
+func (r GeminiRequest) ToOpenAIRequest(model string, stream bool) (OpenAIRequest, error) {
+	format, err := r.GenerationConfig.responseFormat()
+	if err != nil {
+		return OpenAIRequest{}, err
+	}
+	messages := []OpenAIMessage{}
+	if r.SystemInstruction != nil {
+		system, _, err := r.SystemInstruction.Text()
+		if err != nil {
+			return OpenAIRequest{}, err
+		}
+		messages = append(messages, OpenAIMessage{Role: "system", Content: system})
+	}
+	for _, content := range r.Contents {
+		text, images, err := content.Text()
+		if err != nil {
+			return OpenAIRequest{}, err
+		}
+		role := "user"
+		if content.Role == "model" {
+			role = "assistant"
+		}
+		messages = append(messages, OpenAIMessage{Role: role, Content: text, Images: images})
+	}
+	return OpenAIRequest{
+		Model:          model,
+		Messages:       messages,
+		Stream:         stream,
+		Temperature:    r.GenerationConfig.Temperature,
+		MaxTokens:      r.GenerationConfig.MaxOutputTokens,
+		Stop:           r.GenerationConfig.StopSequences,
+		N:              r.GenerationConfig.CandidateCount,
+		ResponseFormat: format,
+	}, nil
+}
+
+type GeminiCandidate struct {
+	Content      GeminiContent `json:"content"`
+	FinishReason string        `json:"finishReason,omitempty"`
+	Index        int           `json:"index"`
+}
+
+type GeminiUsage struct {
+	PromptTokenCount     int `json:"promptTokenCount"`
+	CandidatesTokenCount int `json:"candidatesTokenCount"`
+	TotalTokenCount      int `json:"totalTokenCount"`
+}
+
+type GeminiResponse struct {
+	Candidates    []GeminiCandidate `json:"candidates"`
+	UsageMetadata *GeminiUsage      `json:"usageMetadata,omitempty"`
+	ModelVersion  string            `json:"modelVersion"`
+}
+
+func geminiCandidate(index int, text string, finishReason string) GeminiCandidate {
+	return GeminiCandidate{
+		Content:      GeminiContent{Role: "model", Parts: []GeminiPart{{Text: text}}},
+		FinishReason: finishReason,
+		Index:        index,
+	}
+}
+
+// geminiFinishReason maps the finish reason of the limiter to gemini
+func geminiFinishReason(limiter *outputLimiter) string {
+	if finishReason := limiter.FinishReason(); finishReason != nil && *finishReason == "length" {
+		return "MAX_TOKENS"
+	}
+	return "STOP"
+}
+
+func newGeminiUsage(usage Usage) *GeminiUsage {
+	return &GeminiUsage{
+		PromptTokenCount:     usage.PromptTokens,
+		CandidatesTokenCount: usage.CompletionTokens,
+		TotalTokenCount:      usage.TotalTokens,
+	}
+}
+
+type GeminiErrorResponse struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+	} `json:"error"`
+}
+
+// NewGeminiErrorResponse maps err to its http status and gemini error envelope
+func NewGeminiErrorResponse(err error) (int, GeminiErrorResponse) {
+	status, _ := NewErrorResponse(err)
+	resp := GeminiErrorResponse{}
+	resp.Error.Code = status
+	resp.Error.Message = err.Error()
+	switch status {
+	case http.StatusBadRequest:
+		resp.Error.Status = "INVALID_ARGUMENT"
+	case http.StatusForbidden:
+		resp.Error.Status = "PERMISSION_DENIED"
+	case http.StatusNotFound:
+		resp.Error.Status = "NOT_FOUND"
+	case http.StatusTooManyRequests:
+		resp.Error.Status = "RESOURCE_EXHAUSTED"
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		resp.Error.Status = "UNAVAILABLE"
+	default:
+		resp.Error.Status = "INTERNAL"
+	}
+	return status, resp
+}
+
+func abortWithGeminiError(c *gin.Context, err error) {
+	status, resp := NewGeminiErrorResponse(err)
+	c.AbortWithStatusJSON(status, resp)
+}
+
+// GeminiEndpoint serves POST /v1beta/models/{model}:{method}, the model and the
+// method share the last path segment
+func GeminiEndpoint(c *gin.Context) {
+	action := strings.TrimPrefix(c.Param("action"), "/")
+	model, method := action, ""
+	if i := strings.LastIndex(action, ":"); i >= 0 {
+		model, method = action[:i], action[i+1:]
+	}
+	if method != "generateContent" && method != "streamGenerateContent" {
+		abortWithGeminiError(c, fmt.Errorf("%w: method %q is not supported", ErrModelNotFound, method))
+		return
+	}
+	stream := method == "streamGenerateContent"
+
+	originReq := &GeminiRequest{}
+	if err := c.Copy().ShouldBindJSON(originReq); err != nil {
+		abortWithGeminiError(c, fmt.Errorf("%w: %v", ErrInvalidRequest, err))
+		return
+	}
+	req, err := originReq.ToOpenAIRequest(model, stream)
+	if err != nil {
+		abortWithGeminiError(c, err)
+		return
+	}
+	rayChatReq, sources, err := openChoices(c, &req)
+	if err != nil {
+		abortWithGeminiError(c, err)
+		return
+	}
+	if stream {
+		geminiStreamResp(c, &req, rayChatReq, sources)
+		return
+	}
+
+	candidates := make([]GeminiCandidate, len(sources))
+	completions := make([]string, len(sources))
+	err = eachChoice(c.Request.Context(), sources, func(ctx context.Context, i int, source choiceSource) error {
+		limiter := newOutputLimiter(rayChatReq.Model, req.Stop, req.GetMaxTokens())
+		text := strings.Builder{}
+		err := readText(ctx, source, limiter, func(chunk string) error {
+			text.WriteString(chunk)
+			return nil
+		})
+		completions[i] = text.String()
+		candidates[i] = geminiCandidate(i, completions[i], geminiFinishReason(limiter))
+		return err
+	})
+	if err != nil {
+		abortWithGeminiError(c, err)
+		return
+	}
+	usage := recordUsage(c, rayChatReq.Model, rayChatReq.PromptTokens(), completions)
+	c.JSON(http.StatusOK, GeminiResponse{
+		Candidates:    candidates,
+		UsageMetadata: newGeminiUsage(usage),
+		ModelVersion:  rayChatReq.Model,
+	})
+}
+
+// geminiWriter writes the chunks of a stream as server sent events with
+// alt=sse, as the elements of a json array otherwise. The candidates of the
+// stream may write concurrently.
+type geminiWriter struct {
+	mu      sync.Mutex
+	c       *gin.Context
+	sse     bool
+	written bool
+}
+
+func (w *geminiWriter) Write(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch {
+	case w.sse:
+		_, err = w.c.Writer.WriteString("data: " + string(data) + "\r\n\r\n")
+	case w.written:
+		_, err = w.c.Writer.WriteString(",\r\n" + string(data))
+	default:
+		_, err = w.c.Writer.WriteString("[" + string(data))
+	}
+	if err != nil {
+		return err
+	}
+	w.written = true
+	w.c.Writer.Flush()
+	return nil
+}
+
+// Close ends the json array
+func (w *geminiWriter) Close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch {
+	case w.sse:
+	case w.written:
+		w.c.Writer.WriteString("]")
+	default:
+		w.c.Writer.WriteString("[]")
+	}
+	w.c.Writer.Flush()
+}
+
+func geminiStreamResp(c *gin.Context, req *OpenAIRequest, rayChatReq RayChatRequest, sources []choiceSource) {
+	w := &geminiWriter{c: c, sse: c.Query("alt") == "sse"}
+	contentType := "application/json"
+	if w.sse {
+		contentType = "text/event-stream"
+	}
+	if err := beginStream(c, sources, contentType); err != nil {
+		abortWithGeminiError(c, err)
+		return
+	}
+	defer w.Close()
+
+	model := rayChatReq.Model
+	defer countStream(c, model)()
+
+	candidates := make([]GeminiCandidate, len(sources))
+	completions := make([]string, len(sources))
+	err := eachChoice(c.Request.Context(), sources, func(ctx context.Context, i int, source choiceSource) error {
+		limiter := newOutputLimiter(model, req.Stop, req.GetMaxTokens())
+		completion := strings.Builder{}
+		err := readText(ctx, source, limiter, func(text string) error {
+			completion.WriteString(text)
+			return w.Write(GeminiResponse{
+				Candidates:   []GeminiCandidate{geminiCandidate(i, text, "")},
+				ModelVersion: model,
+			})
+		})
+		completions[i] = completion.String()
+		// the finish reasons are sent with the usage once every candidate is done
+		candidates[i] = geminiCandidate(i, "", geminiFinishReason(limiter))
+		return err
+	})
+	usage := recordUsage(c, model, rayChatReq.PromptTokens(), completions)
+	if streamFailed(c, err, func(err error) {
+		_, errResp := NewGeminiErrorResponse(err)
+		w.Write(errResp)
+	}) {
+		return
+	}
+	w.Write(GeminiResponse{
+		Candidates:    candidates,
+		UsageMetadata: newGeminiUsage(usage),
+		ModelVersion:  model,
+	})
+}
@@ -0,0 +1,173 @@
+package chat
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestLowerCamel(t *testing.T) {
+	tests := map[string]string{
+		"text":                 "text",
+		"inline_data":          "inlineData",
+		"inlineData":           "inlineData",
+		"response_json_schema": "responseJsonSchema",
+		"max__tokens":          "maxTokens",
+		"trailing_":            "trailing",
+	}
+	for name, want := range tests {
+		if got := lowerCamel(name); got != want {
+			t.Errorf("lowerCamel(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestUnmarshalGeminiRequest(t *testing.T) {
+	want := GeminiRequest{
+		Contents: []GeminiContent{{
+			Role: "user",
+			Parts: []GeminiPart{
+				{Text: "describe"},
+				{InlineData: &GeminiBlob{MimeType: "image/png", Data: "aGVsbG8="}},
+				{FileData: &GeminiFileData{MimeType: "image/jpeg", FileURI: "https://example.com/a.jpg"}},
+			},
+		}},
+		SystemInstruction: &GeminiContent{Parts: []GeminiPart{{Text: "be brief"}}},
+		GenerationConfig: GeminiGenerationConfig{
+			Temperature:      0.5,
+			MaxOutputTokens:  10,
+			StopSequences:    []string{"END"},
+			CandidateCount:   2,
+			ResponseMimeType: "application/json",
+		},
+	}
+	tests := []struct {
+		name string
+		data string
+	}{
+		{
+			name: "camel case",
+			data: `{"contents":[{"role":"user","parts":[{"text":"describe"},{"inlineData":{"mimeType":"image/png","data":"aGVsbG8="}},{"fileData":{"mimeType":"image/jpeg","fileUri":"https://example.com/a.jpg"}}]}],
+				"systemInstruction":{"parts":[{"text":"be brief"}]},
+				"generationConfig":{"temperature":0.5,"maxOutputTokens":10,"stopSequences":["END"],"candidateCount":2,"responseMimeType":"application/json"}}`,
+		},
+		{
+			name: "snake case",
+			data: `{"contents":[{"role":"user","parts":[{"text":"describe"},{"inline_data":{"mime_type":"image/png","data":"aGVsbG8="}},{"file_data":{"mime_type":"image/jpeg","file_uri":"https://example.com/a.jpg"}}]}],
+				"system_instruction":{"parts":[{"text":"be brief"}]},
+				"generation_config":{"temperature":0.5,"max_output_tokens":10,"stop_sequences":["END"],"candidate_count":2,"response_mime_type":"application/json"}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got GeminiRequest
+			if err := json.Unmarshal([]byte(tt.data), &got); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+
+	var got GeminiRequest
+	if err := json.Unmarshal([]byte(`{"contents":"nope"}`), &got); err == nil {
+		t.Errorf("contents of the wrong type were accepted")
+	}
+}
+
+func TestGeminiSchema(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		want   string
+	}{
+		{
+			name:   "upper case types",
+			schema: `{"type":"OBJECT","properties":{"name":{"type":"STRING"},"tags":{"type":"ARRAY","items":{"type":"STRING"}}},"required":["name"]}`,
+			want:   `{"type":"object","properties":{"name":{"type":"string"},"tags":{"type":"array","items":{"type":"string"}}},"required":["name"]}`,
+		},
+		{
+			name:   "nullable",
+			schema: `{"type":"STRING","nullable":true}`,
+			want:   `{"type":["string","null"]}`,
+		},
+		{
+			name:   "not nullable",
+			schema: `{"type":"INTEGER","nullable":false}`,
+			want:   `{"type":"integer"}`,
+		},
+		{
+			name:   "property named type",
+			schema: `{"type":"OBJECT","properties":{"type":{"type":"STRING","enum":["A","B"]}}}`,
+			want:   `{"type":"object","properties":{"type":{"type":"string","enum":["A","B"]}}}`,
+		},
+		{
+			name:   "any of",
+			schema: `{"anyOf":[{"type":"NUMBER"},{"type":"BOOLEAN","nullable":true}]}`,
+			want:   `{"anyOf":[{"type":"number"},{"type":["boolean","null"]}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var schema, want any
+			json.Unmarshal([]byte(tt.schema), &schema)
+			json.Unmarshal([]byte(tt.want), &want)
+			data, err := json.Marshal(geminiSchema(schema))
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+			var got any
+			json.Unmarshal(data, &got)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("geminiSchema(%s) = %s, want %s", tt.schema, data, tt.want)
+			}
+		})
+	}
+}
+
+func TestGeminiResponseFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		config GeminiGenerationConfig
+		typ    string
+		schema string
+		err    bool
+	}{
+		{name: "text"},
+		{name: "json mime type", config: GeminiGenerationConfig{ResponseMimeType: "application/json"}, typ: "json_object"},
+		{
+			name:   "json schema as it is",
+			config: GeminiGenerationConfig{ResponseMimeType: "application/json", ResponseJSONSchema: json.RawMessage(`{"type":"OBJECT"}`)},
+			typ:    "json_schema",
+			schema: `{"type":"OBJECT"}`,
+		},
+		{
+			name:   "response schema converted",
+			config: GeminiGenerationConfig{ResponseSchema: json.RawMessage(`{"type":"OBJECT"}`)},
+			typ:    "json_schema",
+			schema: `{"type":"object"}`,
+		},
+		{name: "broken response schema", config: GeminiGenerationConfig{ResponseSchema: json.RawMessage(`{`)}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, err := tt.config.responseFormat()
+			if (err != nil) != tt.err {
+				t.Fatalf("responseFormat error = %v", err)
+			}
+			if tt.typ == "" {
+				if format != nil {
+					t.Errorf("format = %+v, want none", format)
+				}
+				return
+			}
+			if format == nil || format.Type != tt.typ {
+				t.Fatalf("format = %+v, want type %s", format, tt.typ)
+			}
+			if tt.schema != "" && string(format.JSONSchema.Schema) != tt.schema {
+				t.Errorf("schema = %s, want %s", format.JSONSchema.Schema, tt.schema)
+			}
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package chat
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"raychat/settings"
+	"raychat/transport"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// maxImageSize bounds a single image, inline or fetched
+const maxImageSize = 20 << 20
+
+// imageFetchTimeout bounds fetching an image_url given as http(s) url
+const imageFetchTimeout = 30 * time.Second
+
+// contentPart is an element of the array form of message content
+type contentPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	ImageURL struct {
+		URL    string `json:"url"`
+		Detail string `json:"detail"`
+	} `json:"image_url"`
+}
+
+// UnmarshalJSON accepts the content as a string or as an array of text and
+// image_url parts, text parts are joined and image urls kept in Images
+func (m *OpenAIMessage) UnmarshalJSON(data []byte) error {
+	type message OpenAIMessage
+	var raw struct {
+		message
+		Content json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*m = OpenAIMessage(raw.message)
+	if len(raw.Content) == 0 || string(raw.Content) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(raw.Content, &m.Content); err == nil {
+		return nil
+	}
+	var parts []contentPart
+	if err := json.Unmarshal(raw.Content, &parts); err != nil {
+		return fmt.Errorf("content must be a string or an array of content parts: %w", err)
+	}
+	texts := []string{}
+	for _, part := range parts {
+		switch part.Type {
+		case "text":
+			texts = append(texts, part.Text)
+		case "image_url":
+			if part.ImageURL.URL == "" {
+				return fmt.Errorf("image_url part without url")
+			}
+			m.Images = append(m.Images, part.ImageURL.URL)
+		default:
+			return fmt.Errorf("unsupported content part type %q", part.Type)
+		}
+	}
+	m.Content = strings.Join(texts, "\n")
+	return nil
+}
+
+// RayChatAttachment is an image sent along a raycast message
+type RayChatAttachment struct {
+	Type     string `json:"type"`
+	MimeType string `json:"mime_type"`
+	Data     string `json:"data"`
+	url      string
+}
+
+// hasAttachments reports whether any message carries images
+func (r RayChatRequest) hasAttachments() bool {
+	for _, m := range r.Messages {
+		if len(m.Content.Attachments) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// supportsVision reports whether the raycast catalog advertises image input for model
+func supportsVision(model string) bool {
+	info, ok := getPool().ModelInfo(model)
+	return ok && info.SupportsVision()
+}
+
+// SupportsVision reports whether the model has vision in its raycast features
+func (m ModelInfo) SupportsVision() bool {
+	for _, feature := range m.Features {
+		if strings.Contains(strings.ToLower(feature), "vision") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkVision rejects requests with images for models without vision
+func (r RayChatRequest) checkVision() error {
+	if r.hasAttachments() && !supportsVision(r.Model) {
+		return fmt.Errorf("%w: model %s does not support image input", ErrInvalidRequest, r.Model)
+	}
+	return nil
+}
+
+// loadAttachments turns the image urls of the messages into inline data,
+// data urls are decoded and http(s) urls fetched
+func (r RayChatRequest) loadAttachments(ctx context.Context) error {
+	for i := range r.Messages {
+		for j, attachment := range r.Messages[i].Content.Attachments {
+			if attachment.url == "" {
+				continue
+			}
+			mimeType, data, err := loadImage(ctx, attachment.url)
+			if err != nil {
+				return fmt.Errorf("%w: image %d of message %d: %v", ErrInvalidRequest, j, i, err)
+			}
+			r.Messages[i].Content.Attachments[j] = RayChatAttachment{
+				Type:     "image",
+				MimeType: mimeType,
+				Data:     base64.StdEncoding.EncodeToString(data),
+			}
+		}
+	}
+	return nil
+}
+
+func loadImage(ctx context.Context, url string) (string, []byte, error) {
+	if strings.HasPrefix(url, "data:") {
+		return decodeDataURL(url)
+	}
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return "", nil, fmt.Errorf("unsupported image url, use a data url or http(s)")
+	}
+	if !settings.Get().ImageFetch {
+		return "", nil, fmt.Errorf("fetching image urls is disabled, send the image as a data url")
+	}
+	ctx, cancel := context.WithTimeout(ctx, imageFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	client := &http.Client{Transport: newImageTransport()}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", nil, fmt.Errorf("fetch image: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("fetch image: status %d", resp.StatusCode)
+	}
+	mimeType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !strings.HasPrefix(mimeType, "image/") {
+		return "", nil, fmt.Errorf("fetch image: content type %q is not an image", mimeType)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxImageSize+1))
+	if err != nil {
+		return "", nil, fmt.Errorf("fetch image: %v", err)
+	}
+	if len(data) > maxImageSize {
+		return "", nil, fmt.Errorf("image is larger than %d bytes", maxImageSize)
+	}
+	return mimeType, data, nil
+}
+
+// imageTransport fetches image urls through the upstream transport without
+// reaching the internal network, it runs on every redirect hop
+type imageTransport struct {
+	direct  *http.Transport
+	proxied *http.Transport
+}
+
+func newImageTransport() imageTransport {
+	proxied := transport.Default()
+	direct := proxied.Clone()
+	direct.Proxy = nil
+	direct.DisableKeepAlives = true
+	direct.DialContext = (&net.Dialer{
+		Timeout: settings.Get().UpstreamConnectTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip, err := netip.ParseAddr(host)
+			if err != nil {
+				return err
+			}
+			return checkPublicIP(ip)
+		},
+	}).DialContext
+	return imageTransport{direct: direct, proxied: proxied}
+}
+
+func (t imageTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	proxy, err := t.proxied.Proxy(req)
+	if err != nil {
+		return nil, err
+	}
+	if proxy == nil {
+		return t.direct.RoundTrip(req)
+	}
+	// the proxy dials the image host, so check what the host resolves to here.
+	// The proxy resolves it again, a host changing its dns answer in between
+	// (dns rebinding) gets through, the proxy has to block internal addresses
+	// itself to close that.
+	ips, err := net.DefaultResolver.LookupNetIP(req.Context(), "ip", req.URL.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if err := checkPublicIP(ip); err != nil {
+			return nil, err
+		}
+	}
+	return t.proxied.RoundTrip(req)
+}
+
+// cgnat is the shared address space of carrier grade nat, 100.64.0.0/10
+var cgnat = netip.MustParsePrefix("100.64.0.0/10")
+
+// checkPublicIP refuses loopback, private, link-local and other non public addresses
+func checkPublicIP(ip netip.Addr) error {
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || cgnat.Contains(ip) {
+		return fmt.Errorf("image host %s is not a public address", ip)
+	}
+	return nil
+}
+
+// decodeDataURL decodes a base64 data url like data:image/png;base64,...
+func decodeDataURL(url string) (string, []byte, error) {
+	header, payload, ok := strings.Cut(strings.TrimPrefix(url, "data:"), ",")
+	if !ok || !strings.HasSuffix(header, ";base64") {
+		return "", nil, fmt.Errorf("image data url must be base64 encoded")
+	}
+	mimeType := strings.TrimSuffix(header, ";base64")
+	if !strings.HasPrefix(mimeType, "image/") {
+		return "", nil, fmt.Errorf("data url type %q is not an image", mimeType)
+	}
+	if base64.StdEncoding.DecodedLen(len(payload)) > maxImageSize {
+		return "", nil, fmt.Errorf("image is larger than %d bytes", maxImageSize)
+	}
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", nil, fmt.Errorf("decode image data url: %v", err)
+	}
+	return mimeType, data, nil
+}
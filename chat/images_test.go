@@ -0,0 +1,116 @@
+package chat
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestCheckPublicIP(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{ip: "8.8.8.8", public: true},
+		{ip: "2606:4700::1111", public: true},
+		{ip: "127.0.0.1"},
+		{ip: "127.8.8.8"},
+		{ip: "::1"},
+		{ip: "10.0.0.1"},
+		{ip: "172.16.5.4"},
+		{ip: "192.168.1.1"},
+		{ip: "fd00::1"},
+		{ip: "169.254.169.254"},
+		{ip: "fe80::1"},
+		{ip: "100.64.0.1"},
+		{ip: "0.0.0.0"},
+		{ip: "::"},
+		{ip: "224.0.0.1"},
+		{ip: "ff02::1"},
+		{ip: "::ffff:127.0.0.1"},
+		{ip: "::ffff:169.254.169.254"},
+		{ip: "::ffff:8.8.8.8", public: true},
+	}
+	for _, tt := range tests {
+		err := checkPublicIP(netip.MustParseAddr(tt.ip))
+		if (err == nil) != tt.public {
+			t.Errorf("checkPublicIP(%s) = %v, want public %v", tt.ip, err, tt.public)
+		}
+	}
+}
+
+func TestDecodeDataURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		url      string
+		mimeType string
+		data     string
+		err      string
+	}{
+		{name: "png", url: "data:image/png;base64,aGVsbG8=", mimeType: "image/png", data: "hello"},
+		{name: "not base64 encoded", url: "data:image/png,hello", err: "must be base64"},
+		{name: "no payload", url: "data:image/png;base64", err: "must be base64"},
+		{name: "not an image", url: "data:text/plain;base64,aGVsbG8=", err: "is not an image"},
+		{name: "no type", url: "data:;base64,aGVsbG8=", err: "is not an image"},
+		{name: "broken base64", url: "data:image/png;base64,aGVsbG8", err: "decode image data url"},
+		{name: "too large", url: "data:image/png;base64," + strings.Repeat("A", maxImageSize/3*4+8), err: "larger than"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mimeType, data, err := decodeDataURL(tt.url)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || mimeType != tt.mimeType || string(data) != tt.data {
+				t.Errorf("decodeDataURL = %q, %q, %v, want %q, %q", mimeType, data, err, tt.mimeType, tt.data)
+			}
+		})
+	}
+}
+
+func TestLoadImage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write([]byte("png"))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name  string
+		fetch bool
+		url   string
+		err   string
+	}{
+		{name: "data url", url: "data:image/png;base64,aGVsbG8="},
+		{name: "unsupported scheme", fetch: true, url: "file:///etc/passwd", err: "unsupported image url"},
+		{name: "fetching disabled", url: srv.URL, err: "fetching image urls is disabled"},
+		{name: "loopback address", fetch: true, url: srv.URL, err: "not a public address"},
+		{name: "loopback name", fetch: true, url: strings.Replace(srv.URL, "127.0.0.1", "localhost", 1), err: "not a public address"},
+		{name: "link-local address", fetch: true, url: "http://169.254.169.254/latest/meta-data", err: "not a public address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetch := "false"
+			if tt.fetch {
+				fetch = "true"
+			}
+			useTestSettings(t, map[string]string{"IMAGE_FETCH": fetch})
+			_, _, err := loadImage(context.Background(), tt.url)
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("loadImage(%s) = %v", tt.url, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("loadImage(%s) = %v, want %q", tt.url, err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+// errLimitReached stops reading the raycast stream once the output is complete
+var errLimitReached = errors.New("output limit reached")
+
+// StopSequences is either a single string or a list of strings
+type StopSequences []string
+
+func (s *StopSequences) UnmarshalJSON(data []byte) error {
+	var stop string
+	if err := json.Unmarshal(data, &stop); err == nil {
+		if stop != "" {
+			*s = StopSequences{stop}
+		}
+		return nil
+	}
+	var stops []string
+	if err := json.Unmarshal(data, &stops); err != nil {
+		return err
+	}
+	*s = stops
+	return nil
+}
+
+// outputLimiter cuts streamed text at the first stop sequence, also across
+// chunk boundaries, and once the token budget is spent
+type outputLimiter struct {
+	model     string
+	stops     []string
+	maxTokens int
+	pending   string
+	tokens    int
+	done      bool
+	reason    string
+	matched   string
+}
+
+func newOutputLimiter(model string, stops []string, maxTokens int) *outputLimiter {
+	return &outputLimiter{
+		model:     model,
+		stops:     lo.Filter(stops, func(s string, _ int) bool { return s != "" }),
+		maxTokens: maxTokens,
+	}
+}
+
+// Write returns the part of text that may be sent to the client, text that
+// could be the start of a stop sequence is held back until it is decided
+func (l *outputLimiter) Write(text string) string {
+	if l.done {
+		return ""
+	}
+	l.pending += text
+
+	emit := ""
+	if idx, stop := l.firstStop(); idx >= 0 {
+		emit = l.pending[:idx]
+		l.pending = ""
+		l.finish("stop")
+		l.matched = stop
+	} else {
+		keep := 0
+		for _, stop := range l.stops {
+			keep = max(keep, partialSuffix(l.pending, stop))
+		}
+		emit = l.pending[:len(l.pending)-keep]
+		l.pending = l.pending[len(l.pending)-keep:]
+	}
+	return l.spend(emit)
+}
+
+// Close returns the held back text once the upstream stream ended
+func (l *outputLimiter) Close() string {
+	if l.done {
+		return ""
+	}
+	emit := l.pending
+	l.pending = ""
+	return l.spend(emit)
+}
+
+func (l *outputLimiter) spend(text string) string {
+	if l.maxTokens <= 0 || len(text) == 0 {
+		return text
+	}
+	tokens := countTokens(l.model, text)
+	if l.tokens+tokens < l.maxTokens {
+		l.tokens += tokens
+		return text
+	}
+	text = truncateTokens(l.model, text, l.maxTokens-l.tokens)
+	l.tokens = l.maxTokens
+	l.pending = ""
+	l.finish("length")
+	return text
+}
+
+func (l *outputLimiter) finish(reason string) {
+	if l.done {
+		return
+	}
+	l.done = true
+	l.reason = reason
+}
+
+func (l *outputLimiter) firstStop() (int, string) {
+	first, matched := -1, ""
+	for _, stop := range l.stops {
+		if idx := strings.Index(l.pending, stop); idx >= 0 && (first < 0 || idx < first) {
+			first, matched = idx, stop
+		}
+	}
+	return first, matched
+}
+
+// Done reports whether the output is complete and the upstream read can be stopped
+func (l *outputLimiter) Done() bool {
+	return l.done
+}
+
+// FinishReason returns "stop" or "length" once a limit was hit, nil otherwise
+func (l *outputLimiter) FinishReason() *string {
+	if !l.done {
+		return nil
+	}
+	return &l.reason
+}
+
+// StopSequence returns the stop sequence the output was cut at
+func (l *outputLimiter) StopSequence() *string {
+	if l.matched == "" {
+		return nil
+	}
+	return &l.matched
+}
@@ -0,0 +1,161 @@
+package chat
+
+import (
+	"testing"
+
+	"github.com/samber/lo"
+)
+
+// limitText writes chunks to l and returns the text that went out
+func limitText(l *outputLimiter, chunks ...string) string {
+	out := ""
+	for _, chunk := range chunks {
+		out += l.Write(chunk)
+	}
+	return out + l.Close()
+}
+
+func TestOutputLimiterStops(t *testing.T) {
+	tests := []struct {
+		name   string
+		stops  []string
+		text   string
+		want   string
+		reason *string
+		stop   *string
+	}{
+		{
+			name: "no stop",
+			text: "hello world",
+			want: "hello world",
+		},
+		{
+			name:   "stop in the middle",
+			stops:  []string{"STOP"},
+			text:   "hello STOP world",
+			want:   "hello ",
+			reason: lo.ToPtr("stop"),
+			stop:   lo.ToPtr("STOP"),
+		},
+		{
+			name:   "earliest stop wins",
+			stops:  []string{"world", "lo"},
+			text:   "hello world",
+			want:   "hel",
+			reason: lo.ToPtr("stop"),
+			stop:   lo.ToPtr("lo"),
+		},
+		{
+			name:  "partial stop at the end is flushed",
+			stops: []string{"STOP"},
+			text:  "hello ST",
+			want:  "hello ST",
+		},
+		{
+			name:   "stop at the start",
+			stops:  []string{"\n\n"},
+			text:   "\n\nhello",
+			want:   "",
+			reason: lo.ToPtr("stop"),
+			stop:   lo.ToPtr("\n\n"),
+		},
+		{
+			name:  "empty stops are ignored",
+			stops: []string{""},
+			text:  "hello",
+			want:  "hello",
+		},
+	}
+	for _, tt := range tests {
+		// split the text at every pair of positions so stops straddle chunk boundaries
+		for i := 0; i <= len(tt.text); i++ {
+			for j := i; j <= len(tt.text); j++ {
+				l := newOutputLimiter("gpt-4", tt.stops, 0)
+				got := limitText(l, tt.text[:i], tt.text[i:j], tt.text[j:])
+				if got != tt.want {
+					t.Errorf("%s split at %d and %d: got %q, want %q", tt.name, i, j, got, tt.want)
+				}
+				if !equalPtr(l.FinishReason(), tt.reason) || !equalPtr(l.StopSequence(), tt.stop) {
+					t.Errorf("%s split at %d and %d: finish reason %v and stop %v", tt.name, i, j, l.FinishReason(), l.StopSequence())
+				}
+				if l.Done() != (tt.reason != nil) {
+					t.Errorf("%s split at %d and %d: done = %v", tt.name, i, j, l.Done())
+				}
+			}
+		}
+	}
+}
+
+func TestOutputLimiterMaxTokens(t *testing.T) {
+	tests := []struct {
+		name      string
+		stops     []string
+		maxTokens int
+		chunks    []string
+		want      string
+		reason    *string
+	}{
+		{
+			name:   "no budget",
+			chunks: []string{"hello", " world", " foo"},
+			want:   "hello world foo",
+		},
+		{
+			name:      "within budget",
+			maxTokens: 10,
+			chunks:    []string{"hello", " world"},
+			want:      "hello world",
+		},
+		{
+			name:      "cut across chunks",
+			maxTokens: 2,
+			chunks:    []string{"hello", " world", " foo", " bar"},
+			want:      "hello world",
+			reason:    lo.ToPtr("length"),
+		},
+		{
+			name:      "cut inside a chunk",
+			maxTokens: 3,
+			chunks:    []string{"hello world foo bar"},
+			want:      "hello world foo",
+			reason:    lo.ToPtr("length"),
+		},
+		{
+			name:      "stop before the budget",
+			stops:     []string{" foo"},
+			maxTokens: 3,
+			chunks:    []string{"hello world foo bar"},
+			want:      "hello world",
+			reason:    lo.ToPtr("stop"),
+		},
+		{
+			name:      "budget before the stop",
+			stops:     []string{" bar"},
+			maxTokens: 1,
+			chunks:    []string{"hello", " world bar"},
+			want:      "hello",
+			reason:    lo.ToPtr("length"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newOutputLimiter("gpt-4", tt.stops, tt.maxTokens)
+			if got := limitText(l, tt.chunks...); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if !equalPtr(l.FinishReason(), tt.reason) {
+				t.Errorf("finish reason = %v, want %v", l.FinishReason(), tt.reason)
+			}
+			if l.Write("more") != "" && l.Done() {
+				t.Errorf("text written after the limit went out")
+			}
+		})
+	}
+}
+
+func equalPtr(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
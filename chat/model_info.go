@@ -1,11 +1,12 @@
 package chat
 
 import (
-	"github.com/imroc/req/v3"
+	"fmt"
+	"raychat/transport"
 )
 
-func (r *RayChat) GetSupportedModels() map[string]string {
-	c := req.C().SetCommonHeaders(map[string]string{
+func (r *RayChat) GetAIInfo() (GetAIInfoResponse, error) {
+	c := transport.Req(r.Transport).SetCommonHeaders(map[string]string{
 		"Accept":          "application/json",
 		"Accept-Language": "zh-CN,zh-Hans;q=0.9",
 		"User-Agent":      "Raycast/0 CFNetwork/1408.0.4 Darwin/22.5.0",
@@ -16,13 +17,24 @@ func (r *RayChat) GetSupportedModels() map[string]string {
 	resp := GetAIInfoResponse{}
 
 	res, err := c.R().SetSuccessResult(&resp).Get("https://backend.raycast.com/api/v1/ai/models")
+	if err != nil && res != nil && res.IsSuccessState() {
+		return resp, fmt.Errorf("%w: get model info: %v", ErrBadUpstreamPayload, err)
+	}
 	if err != nil {
-		Logger().WithError(err).Panic("get model info failed")
+		return resp, fmt.Errorf("%w: get model info: %v", ErrUpstreamUnavailable, err)
 	}
 	if res.StatusCode != 200 {
-		Logger().WithField("status code", res.StatusCode).Panic("get model info failed")
+		return resp, upstreamStatusError(res.StatusCode, res.Bytes())
 	}
-	Logger().Infof("get model info success, support those models: [%+v], resp: [%+v]", resp.SupporedModels(), resp)
+	Logger().Infof("get model info success, %d models in the catalog", len(resp.Models))
+
+	return resp, nil
+}
 
-	return resp.SupporedModels()
+func (r *RayChat) GetSupportedModels() (map[string]string, error) {
+	info, err := r.GetAIInfo()
+	if err != nil {
+		return nil, err
+	}
+	return info.SupporedModels(), nil
 }
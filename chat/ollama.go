@@ -0,0 +1,296 @@
+package chat
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/samber/lo"
+)
+
+type OllamaMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	// Images are base64 encoded, without data url prefix
+	Images []string `json:"images,omitempty"`
+}
+
+type OllamaOptions struct {
+	Temperature float64       `json:"temperature"`
+	NumPredict  int           `json:"num_predict"`
+	Stop        StopSequences `json:"stop"`
+}
+
+type OllamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []OllamaMessage `json:"messages"`
+	Stream   *bool           `json:"stream"`
+	Format   json.RawMessage `json:"format"`
+	Options  OllamaOptions   `json:"options"`
+}
+
+type OllamaGenerateRequest struct {
+	Model   string          `json:"model"`
+	Prompt  string          `json:"prompt"`
+	Suffix  string          `json:"suffix"`
+	System  string          `json:"system"`
+	Images  []string        `json:"images"`
+	Stream  *bool           `json:"stream"`
+	Format  json.RawMessage `json:"format"`
+	Options OllamaOptions   `json:"options"`
+}
+
+type OllamaResponse struct {
+	Model     string         `json:"model"`
+	CreatedAt time.Time      `json:"created_at"`
+	Message   *OllamaMessage `json:"message,omitempty"`
+	// Response is the text of /api/generate, Message the one of /api/chat
+	Response           *string `json:"response,omitempty"`
+	Done               bool    `json:"done"`
+	DoneReason         string  `json:"done_reason,omitempty"`
+	TotalDuration      int64   `json:"total_duration,omitempty"`
+	LoadDuration       int64   `json:"load_duration,omitempty"`
+	PromptEvalCount    int     `json:"prompt_eval_count,omitempty"`
+	PromptEvalDuration int64   `json:"prompt_eval_duration,omitempty"`
+	EvalCount          int     `json:"eval_count,omitempty"`
+	EvalDuration       int64   `json:"eval_duration,omitempty"`
+}
+
+// ollamaStream reports whether to stream, ollama streams unless told not to
+func ollamaStream(stream *bool) bool {
+	return stream == nil || *stream
+}
+
+// ollamaFormat maps format, "json" or a json schema, to the response format
+func ollamaFormat(format json.RawMessage) (*ResponseFormat, error) {
+	if len(format) == 0 || string(format) == "null" || string(format) == `""` {
+		return nil, nil
+	}
+	if string(format) == `"json"` {
+		return &ResponseFormat{Type: "json_object"}, nil
+	}
+	if !strings.HasPrefix(strings.TrimSpace(string(format)), "{") {
+		return nil, fmt.Errorf("%w: format must be \"json\" or a json schema", ErrInvalidRequest)
+	}
+	return &ResponseFormat{Type: "json_schema", JSONSchema: &JSONSchemaFormat{Schema: format}}, nil
+}
+
+// ollamaImages turns base64 images into data urls, the type is sniffed from the data
+func ollamaImages(images []string) ([]string, error) {
+	urls := []string{}
+	for i, image := range images {
+		head, err := base64.StdEncoding.DecodeString(image[:min(len(image), 64)])
+		if err != nil {
+			return nil, fmt.Errorf("%w: image %d is not base64 encoded", ErrInvalidRequest, i)
+		}
+		urls = append(urls, "data:"+http.DetectContentType(head)+";base64,"+image)
+	}
+	return urls, nil
+}
+
+// ollamaModel drops the tag ollama clients add to model names
+func ollamaModel(model string) string {
+	return strings.TrimSuffix(model, ":latest")
+}
+
+func (o OllamaOptions) maxTokens() int {
+	// num_predict -1 is unlimited and -2 fills the context
+	return max(o.NumPredict, 0)
+}
+
+func (r OllamaChatRequest) ToOpenAIRequest() (OpenAIRequest, error) {
+	format, err := ollamaFormat(r.Format)
+	if err != nil {
+		return OpenAIRequest{}, err
+	}
+	messages := []OpenAIMessage{}
+	for _, m := range r.Messages {
+		images, err := ollamaImages(m.Images)
+		if err != nil {
+			return OpenAIRequest{}, err
+		}
+		messages = append(messages, OpenAIMessage{Role: m.Role, Content: m.Content, Images: images})
+	}
+	return OpenAIRequest{
+		Model:          ollamaModel(r.Model),
+		Messages:       messages,
+		Stream:         ollamaStream(r.Stream),
+		Temperature:    r.Options.Temperature,
+		MaxTokens:      r.Options.maxTokens(),
+		Stop:           r.Options.Stop,
+		ResponseFormat: format,
+	}, nil
+}
+
+func (r OllamaGenerateRequest) ToOpenAIRequest() (OpenAIRequest, error) {
+	format, err := ollamaFormat(r.Format)
+	if err != nil {
+		return OpenAIRequest{}, err
+	}
+	images, err := ollamaImages(r.Images)
+	if err != nil {
+		return OpenAIRequest{}, err
+	}
+	system := r.System
+	if r.Suffix != "" {
+		system = strings.TrimSpace(system + "\n" + completionInstructions + suffixInstructions(r.Suffix))
+	}
+	messages := []OpenAIMessage{}
+	if system != "" {
+		messages = append(messages, OpenAIMessage{Role: "system", Content: system})
+	}
+	messages = append(messages, OpenAIMessage{Role: "user", Content: r.Prompt, Images: images})
+	return OpenAIRequest{
+		Model:          ollamaModel(r.Model),
+		Messages:       messages,
+		Stream:         ollamaStream(r.Stream),
+		Temperature:    r.Options.Temperature,
+		MaxTokens:      r.Options.maxTokens(),
+		Stop:           r.Options.Stop,
+		ResponseFormat: format,
+	}, nil
+}
+
+// ollamaReply builds the responses of one of the two endpoints
+type ollamaReply struct {
+	model    string
+	generate bool
+}
+
+func (o ollamaReply) response(text string) OllamaResponse {
+	resp := OllamaResponse{Model: o.model, CreatedAt: time.Now().UTC()}
+	if o.generate {
+		resp.Response = &text
+	} else {
+		resp.Message = &OllamaMessage{Role: "assistant", Content: text}
+	}
+	return resp
+}
+
+func OllamaChatEndpoint(c *gin.Context) {
+	originReq := &OllamaChatRequest{}
+	if err := c.Copy().ShouldBindJSON(originReq); err != nil {
+		abortWithOllamaError(c, fmt.Errorf("%w: %v", ErrInvalidRequest, err))
+		return
+	}
+	reply := ollamaReply{model: originReq.Model}
+	if len(originReq.Messages) == 0 {
+		// an empty chat loads the model in ollama, raycast has nothing to load
+		resp := reply.response("")
+		resp.Done, resp.DoneReason = true, "load"
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+	req, err := originReq.ToOpenAIRequest()
+	if err != nil {
+		abortWithOllamaError(c, err)
+		return
+	}
+	ollamaEndpoint(c, reply, req)
+}
+
+func OllamaGenerateEndpoint(c *gin.Context) {
+	originReq := &OllamaGenerateRequest{}
+	if err := c.Copy().ShouldBindJSON(originReq); err != nil {
+		abortWithOllamaError(c, fmt.Errorf("%w: %v", ErrInvalidRequest, err))
+		return
+	}
+	reply := ollamaReply{model: originReq.Model, generate: true}
+	if originReq.Prompt == "" && len(originReq.Images) == 0 {
+		resp := reply.response("")
+		resp.Done, resp.DoneReason = true, "load"
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+	req, err := originReq.ToOpenAIRequest()
+	if err != nil {
+		abortWithOllamaError(c, err)
+		return
+	}
+	ollamaEndpoint(c, reply, req)
+}
+
+// ollamaEndpoint sends req the way ChatEndpoint does and answers in the ollama format
+func ollamaEndpoint(c *gin.Context, reply ollamaReply, req OpenAIRequest) {
+	start := time.Now()
+	rayChatReq, sources, err := openChoices(c, &req)
+	if err != nil {
+		abortWithOllamaError(c, err)
+		return
+	}
+	model := rayChatReq.Model
+	if req.Stream {
+		if err := beginStream(c, sources, "application/x-ndjson"); err != nil {
+			abortWithOllamaError(c, err)
+			return
+		}
+		defer countStream(c, model)()
+	}
+
+	limiter := newOutputLimiter(model, req.Stop, req.GetMaxTokens())
+	completion := strings.Builder{}
+	var firstToken time.Time
+	err = readText(c.Request.Context(), sources[0], limiter, func(text string) error {
+		if firstToken.IsZero() {
+			firstToken = time.Now()
+		}
+		completion.WriteString(text)
+		if !req.Stream {
+			return nil
+		}
+		return writeNDJSON(c, reply.response(text))
+	})
+	usage := recordUsage(c, model, rayChatReq.PromptTokens(), []string{completion.String()})
+	if !req.Stream && err != nil {
+		abortWithOllamaError(c, err)
+		return
+	}
+	if streamFailed(c, err, func(err error) { writeNDJSON(c, gin.H{"error": err.Error()}) }) {
+		return
+	}
+
+	end := time.Now()
+	if firstToken.IsZero() {
+		firstToken = end
+	}
+	text := ""
+	if !req.Stream {
+		text = completion.String()
+	}
+	resp := reply.response(text)
+	resp.Done = true
+	resp.DoneReason = lo.FromPtrOr(limiter.FinishReason(), "stop")
+	resp.TotalDuration = end.Sub(start).Nanoseconds()
+	resp.PromptEvalCount = usage.PromptTokens
+	resp.PromptEvalDuration = firstToken.Sub(start).Nanoseconds()
+	resp.EvalCount = usage.CompletionTokens
+	resp.EvalDuration = end.Sub(firstToken).Nanoseconds()
+	if req.Stream {
+		writeNDJSON(c, resp)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// writeNDJSON writes v as a line of the stream and flushes it
+func writeNDJSON(c *gin.Context, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := c.Writer.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	c.Writer.Flush()
+	return nil
+}
+
+// abortWithOllamaError answers err in the {"error": "..."} shape of ollama
+func abortWithOllamaError(c *gin.Context, err error) {
+	status, _ := NewErrorResponse(err)
+	c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+}
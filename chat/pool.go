@@ -0,0 +1,350 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"raychat/settings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+// reloadInterval is how often accounts that failed to load are retried
+const reloadInterval = time.Minute
+
+var ErrNoAccount = errors.New("no raycast account available for this model")
+
+// Pool spreads requests across raycast accounts, accounts in cool-down are skipped
+// unless every account able to serve the model is cooling down.
+type Pool struct {
+	mu       sync.RWMutex
+	accounts []*Account
+	strategy string
+	cooldown time.Duration
+	next     atomic.Uint64
+
+	breakerThreshold int
+	breakerCooldown  time.Duration
+
+	fanout int
+	// freed is closed once an extra choice gives its fan-out slot back
+	freedMu sync.Mutex
+	freed   chan struct{}
+
+	// generation changes on every Apply, loads of an older config are dropped
+	generation atomic.Uint64
+}
+
+func NewPool(conf settings.RayConfig) *Pool {
+	p := &Pool{
+		strategy: conf.BalanceStrategy,
+		cooldown: conf.AccountCooldown,
+
+		breakerThreshold: conf.BreakerThreshold,
+		breakerCooldown:  conf.BreakerCooldown,
+
+		fanout: conf.FanoutPerAccount,
+	}
+	failed := p.load(conf.GetAccounts(), conf.TokenTTL, 0)
+	if len(p.Accounts()) == 0 {
+		Logger().Error("no raycast account loaded, check EMAIL/PASSWORD, TOKEN or ACCOUNTS")
+	}
+	if len(failed) > 0 {
+		go p.reload(failed, conf.TokenTTL, 0)
+	}
+	return p
+}
+
+// Apply updates the pool to a reloaded config, accounts that were removed or
+// changed are dropped and new or changed ones are loaded in the background.
+// Requests in flight on a dropped account finish normally.
+func (p *Pool) Apply(conf settings.RayConfig) {
+	generation := p.generation.Add(1)
+	wanted := map[string]settings.AccountConfig{}
+	for _, accountConf := range conf.GetAccounts() {
+		wanted[accountConf.Name] = accountConf
+	}
+
+	p.mu.Lock()
+	p.strategy, p.cooldown = conf.BalanceStrategy, conf.AccountCooldown
+	p.breakerThreshold, p.breakerCooldown = conf.BreakerThreshold, conf.BreakerCooldown
+	p.fanout = conf.FanoutPerAccount
+	kept := []*Account{}
+	for _, a := range p.accounts {
+		if accountConf, ok := wanted[a.Name]; ok && accountConf == a.conf {
+			a.breaker.Configure(conf.BreakerThreshold, conf.BreakerCooldown)
+			kept = append(kept, a)
+			delete(wanted, a.Name)
+		} else {
+			a.Logger().Info("account removed or changed by config reload")
+		}
+	}
+	p.accounts = kept
+	p.mu.Unlock()
+	// a raised fan-out limit may let waiting choices through
+	p.signalFanout()
+
+	if len(wanted) == 0 {
+		return
+	}
+	confs := make([]settings.AccountConfig, 0, len(wanted))
+	for _, accountConf := range conf.GetAccounts() {
+		if _, ok := wanted[accountConf.Name]; ok {
+			confs = append(confs, accountConf)
+		}
+	}
+	go func() {
+		if failed := p.load(confs, conf.TokenTTL, generation); len(failed) > 0 {
+			p.reload(failed, conf.TokenTTL, generation)
+		}
+	}()
+}
+
+// load adds the accounts to the pool and returns the ones failed to load,
+// nothing is added once the config of generation has been replaced
+func (p *Pool) load(confs []settings.AccountConfig, ttl time.Duration, generation uint64) []settings.AccountConfig {
+	failed := []settings.AccountConfig{}
+	for _, accountConf := range confs {
+		account, err := loadAccount(accountConf, ttl)
+		if err != nil {
+			Logger().WithError(err).Error("load raycast account failed, retry later")
+			failed = append(failed, accountConf)
+			continue
+		}
+		p.mu.Lock()
+		if p.generation.Load() != generation {
+			p.mu.Unlock()
+			return nil
+		}
+		account.breaker = newBreaker(p.breakerThreshold, p.breakerCooldown)
+		p.accounts = append(p.accounts, account)
+		p.mu.Unlock()
+		account.Logger().Infof("raycast account loaded, support %d models", len(account.Models()))
+	}
+	return failed
+}
+
+func (p *Pool) reload(failed []settings.AccountConfig, ttl time.Duration, generation uint64) {
+	for len(failed) > 0 && p.generation.Load() == generation {
+		time.Sleep(reloadInterval)
+		failed = p.load(failed, ttl, generation)
+	}
+}
+
+// poolSettings are the reloadable settings of the pool
+type poolSettings struct {
+	strategy string
+	cooldown time.Duration
+	fanout   int
+}
+
+func (p *Pool) settings() poolSettings {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return poolSettings{strategy: p.strategy, cooldown: p.cooldown, fanout: p.fanout}
+}
+
+func (p *Pool) Accounts() []*Account {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.accounts
+}
+
+// errFanoutBusy is returned by pick while every account able to serve the
+// model has FANOUT_PER_ACCOUNT extra choices in flight
+var errFanoutBusy = errors.New("fan-out limit reached")
+
+// Pick chooses an account for model and marks a request in flight on it,
+// callers must Release the account once the request is done. Accounts with an
+// open circuit are never picked, ErrCircuitOpen is returned if that is all of them.
+// Extra choices, see withFanout, wait for an account with a free fan-out slot.
+func (p *Pool) Pick(ctx context.Context, model string) (*Account, error) {
+	lease, ok := ctx.Value(fanoutKey{}).(*fanoutLease)
+	if !ok {
+		return p.pick(model, 0)
+	}
+	// a retry gives the slot of the previous attempt back first
+	lease.release()
+	for {
+		freed := p.fanoutFreed()
+		limit := p.settings().fanout
+		account, err := p.pick(model, limit)
+		if err != errFanoutBusy {
+			if err == nil && limit > 0 {
+				lease.account = account
+			}
+			return account, err
+		}
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// pick chooses an account with fewer than limit extra choices in flight and
+// takes one of its fan-out slots, a zero limit picks any account
+func (p *Pool) pick(model string, limit int) (*Account, error) {
+	supported := false
+	candidates := []*Account{}
+	for _, a := range p.Accounts() {
+		if !a.Supports(model) {
+			continue
+		}
+		supported = true
+		if a.breaker.Ready() {
+			candidates = append(candidates, a)
+		}
+	}
+	if !supported {
+		return nil, ErrNoAccount
+	}
+	err := ErrCircuitOpen
+	for len(candidates) > 0 {
+		picked := p.choose(candidates)
+		candidates = lo.Without(candidates, picked)
+		if limit > 0 && !picked.reserveFanout(limit) {
+			err = errFanoutBusy
+			continue
+		}
+		// another request may have taken the trial of an open circuit meanwhile
+		if !picked.breaker.TryAcquire() {
+			if limit > 0 {
+				picked.fanout.Add(-1)
+				p.signalFanout()
+			}
+			continue
+		}
+		picked.inflight.Add(1)
+		return picked, nil
+	}
+	return nil, err
+}
+
+// choose picks one of candidates with the balance strategy
+func (p *Pool) choose(candidates []*Account) *Account {
+	available := []*Account{}
+	for _, a := range candidates {
+		if a.Available() {
+			available = append(available, a)
+		}
+	}
+	if len(available) == 0 {
+		// everyone is cooling down, try the one coming back first
+		picked := candidates[0]
+		for _, a := range candidates[1:] {
+			if a.cooldownUntil.Load() < picked.cooldownUntil.Load() {
+				picked = a
+			}
+		}
+		return picked
+	}
+	if p.settings().strategy == settings.BalanceLeastInflight {
+		picked := available[0]
+		for _, a := range available[1:] {
+			if a.Inflight() < picked.Inflight() {
+				picked = a
+			}
+		}
+		return picked
+	}
+	return available[p.next.Add(1)%uint64(len(available))]
+}
+
+// Report forwards the raycast response status to the account that served it
+func (p *Pool) Report(a *Account, token string, statusCode int) {
+	a.ReportStatus(token, statusCode, p.settings().cooldown)
+}
+
+// Models returns the union of the models every account is eligible for
+func (p *Pool) Models() map[string]string {
+	models := map[string]string{}
+	for _, a := range p.Accounts() {
+		for model, provider := range a.Models() {
+			if _, ok := models[model]; !ok {
+				models[model] = provider
+			}
+		}
+	}
+	return models
+}
+
+type fanoutKey struct{}
+
+// fanoutLease holds the fan-out slot an extra choice takes on its account
+type fanoutLease struct {
+	pool    *Pool
+	account *Account
+}
+
+// withFanout marks requests sent with ctx as an extra choice of a request, Pick
+// only sends them to accounts with fewer than FANOUT_PER_ACCOUNT extra choices
+// in flight, across all requests, and waits for a free slot otherwise. The
+// slot is held until the lease is released.
+func withFanout(ctx context.Context, p *Pool) (context.Context, *fanoutLease) {
+	lease := &fanoutLease{pool: p}
+	return context.WithValue(ctx, fanoutKey{}, lease), lease
+}
+
+func (l *fanoutLease) release() {
+	if l.account == nil {
+		return
+	}
+	l.account.fanout.Add(-1)
+	l.account = nil
+	l.pool.signalFanout()
+}
+
+// fanoutFreed returns a channel closed once a fan-out slot is given back
+func (p *Pool) fanoutFreed() <-chan struct{} {
+	p.freedMu.Lock()
+	defer p.freedMu.Unlock()
+	if p.freed == nil {
+		p.freed = make(chan struct{})
+	}
+	return p.freed
+}
+
+func (p *Pool) signalFanout() {
+	p.freedMu.Lock()
+	defer p.freedMu.Unlock()
+	if p.freed != nil {
+		close(p.freed)
+		p.freed = nil
+	}
+}
+
+// ModelInfo returns the catalog entry of model from the first account that has it
+func (p *Pool) ModelInfo(model string) (ModelInfo, bool) {
+	for _, a := range p.Accounts() {
+		for _, info := range a.aiInfo.Models {
+			if info.Model == model {
+				return info, true
+			}
+		}
+	}
+	return ModelInfo{}, false
+}
+
+// ModelInfos returns the union of the account catalogs and the time the oldest one was fetched
+func (p *Pool) ModelInfos() ([]ModelInfo, time.Time) {
+	seen := map[string]bool{}
+	infos := []ModelInfo{}
+	fetchedAt := time.Now()
+	for _, a := range p.Accounts() {
+		if a.aiInfoAt.Before(fetchedAt) {
+			fetchedAt = a.aiInfoAt
+		}
+		for _, info := range a.aiInfo.Models {
+			if seen[info.Model] {
+				continue
+			}
+			seen[info.Model] = true
+			infos = append(infos, info)
+		}
+	}
+	return infos, fetchedAt
+}
@@ -0,0 +1,40 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"raychat/settings"
+)
+
+var ErrModelNotFound = errors.New("model not found")
+
+// resolveModel returns the raycast model and provider serving model. Models
+// raycast knows are served as they are, then MODEL_ALIASES are tried in order.
+// Unknown models fail with ErrModelNotFound in strict mode and fall back to
+// DEFAULT_MODEL otherwise.
+func resolveModel(model string) (string, string, error) {
+	models := getPool().Models()
+	if provider, ok := models[model]; ok {
+		return model, provider, nil
+	}
+	conf := settings.Get()
+	for _, alias := range conf.ModelAliases {
+		if ok, _ := path.Match(alias.Match, model); ok || alias.Match == model {
+			provider := alias.Provider
+			if provider == "" {
+				provider = models[alias.Model]
+			}
+			return alias.Model, provider, nil
+		}
+	}
+	if len(models) == 0 {
+		// no account is loaded yet, let the request fail as unavailable
+		return model, "", nil
+	}
+	if conf.StrictModels {
+		return "", "", fmt.Errorf("%w: the model `%s` does not exist", ErrModelNotFound, model)
+	}
+	Logger().Warnf("unknown model %s, fall back to %s", model, conf.DefaultModel)
+	return conf.DefaultModel, models[conf.DefaultModel], nil
+}
@@ -0,0 +1,85 @@
+package chat
+
+import (
+	"errors"
+	"raychat/settings"
+	"testing"
+)
+
+// useTestPool serves the models of catalog, model to provider, for the test
+func useTestPool(t *testing.T, catalog map[string]string) {
+	t.Helper()
+	account := &Account{models: catalog}
+	for model, provider := range catalog {
+		account.aiInfo.Models = append(account.aiInfo.Models, ModelInfo{Model: model, Provider: provider})
+	}
+	old := pool
+	pool = &Pool{accounts: []*Account{account}}
+	if len(catalog) == 0 {
+		pool = &Pool{}
+	}
+	t.Cleanup(func() { pool = old })
+}
+
+// useTestSettings reloads the config with env set for the test
+func useTestSettings(t *testing.T, env map[string]string) {
+	t.Helper()
+	// registered first so it runs once the env is restored
+	t.Cleanup(func() { settings.Reload() })
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	if err := settings.Reload(); err != nil {
+		t.Fatalf("reload settings: %v", err)
+	}
+}
+
+func TestResolveModel(t *testing.T) {
+	catalog := map[string]string{
+		"openai-gpt-4o":           "openai",
+		"anthropic-claude-sonnet": "anthropic",
+		"gpt-3.5-turbo":           "openai",
+	}
+	aliases := `[{"match":"gpt-4o*","model":"openai-gpt-4o"},{"match":"claude-3-5-sonnet","model":"anthropic-claude-sonnet","provider":"bedrock"},{"match":"gpt-*","model":"gpt-3.5-turbo"}]`
+	tests := []struct {
+		name     string
+		catalog  map[string]string
+		strict   bool
+		model    string
+		want     string
+		provider string
+		err      error
+	}{
+		{name: "catalog model", catalog: catalog, model: "openai-gpt-4o", want: "openai-gpt-4o", provider: "openai"},
+		{name: "glob alias", catalog: catalog, model: "gpt-4o-mini", want: "openai-gpt-4o", provider: "openai"},
+		{name: "alias provider wins", catalog: catalog, model: "claude-3-5-sonnet", want: "anthropic-claude-sonnet", provider: "bedrock"},
+		{name: "first alias wins", catalog: catalog, model: "gpt-4o", want: "openai-gpt-4o", provider: "openai"},
+		{name: "later alias", catalog: catalog, model: "gpt-4-turbo", want: "gpt-3.5-turbo", provider: "openai"},
+		{name: "unknown falls back", catalog: catalog, model: "llama-3", want: "gpt-3.5-turbo", provider: "openai"},
+		{name: "unknown in strict mode", catalog: catalog, strict: true, model: "llama-3", err: ErrModelNotFound},
+		{name: "alias in strict mode", catalog: catalog, strict: true, model: "gpt-4o", want: "openai-gpt-4o", provider: "openai"},
+		{name: "no catalog yet", model: "llama-3", want: "llama-3"},
+		{name: "alias without catalog", model: "gpt-4o", want: "openai-gpt-4o"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestPool(t, tt.catalog)
+			strict := "false"
+			if tt.strict {
+				strict = "true"
+			}
+			useTestSettings(t, map[string]string{
+				"MODEL_ALIASES": aliases,
+				"STRICT_MODELS": strict,
+				"DEFAULT_MODEL": "gpt-3.5-turbo",
+			})
+			model, provider, err := resolveModel(tt.model)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("resolveModel(%q) error = %v, want %v", tt.model, err, tt.err)
+			}
+			if model != tt.want || provider != tt.provider {
+				t.Errorf("resolveModel(%q) = %q, %q, want %q, %q", tt.model, model, provider, tt.want, tt.provider)
+			}
+		})
+	}
+}
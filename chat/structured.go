@@ -0,0 +1,241 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"raychat/settings"
+	"raychat/stats"
+	"slices"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+var ErrInvalidStructuredOutput = fmt.Errorf("%w: the model did not produce valid json", ErrBadUpstreamPayload)
+
+type ResponseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *JSONSchemaFormat `json:"json_schema"`
+}
+
+type JSONSchemaFormat struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Schema      json.RawMessage `json:"schema"`
+	Strict      bool            `json:"strict"`
+}
+
+// UseJSON reports whether the client asked for json output
+func (r OpenAIRequest) UseJSON() bool {
+	return r.ResponseFormat != nil && (r.ResponseFormat.Type == "json_object" || r.ResponseFormat.Type == "json_schema")
+}
+
+func (r OpenAIRequest) responseFormatInstructions() string {
+	b := strings.Builder{}
+	b.WriteString("Respond with a single valid JSON value only. Do not use markdown, do not wrap it in code fences and do not add any text before or after it.\n")
+	if f := r.ResponseFormat.JSONSchema; r.ResponseFormat.Type == "json_schema" && f != nil {
+		if f.Description != "" {
+			b.WriteString("The JSON describes: " + f.Description + "\n")
+		}
+		b.WriteString("The JSON must validate against this JSON Schema:\n")
+		b.Write(f.Schema)
+		b.WriteString("\n")
+	} else {
+		b.WriteString("The JSON value must be an object.\n")
+	}
+	return b.String()
+}
+
+// schemaURL names the schema of the request for the compiler
+const schemaURL = "mem://response_format.json"
+
+// outputValidator checks the answer of a json mode request and asks the model
+// again when it is not valid
+type outputValidator struct {
+	req    OpenAIRequest
+	schema *jsonschema.Schema
+}
+
+// newOutputValidator returns nil if the request is not in json mode
+func newOutputValidator(r OpenAIRequest) (*outputValidator, error) {
+	if r.ResponseFormat == nil {
+		return nil, nil
+	}
+	switch r.ResponseFormat.Type {
+	case "", "text":
+		return nil, nil
+	case "json_object":
+		return &outputValidator{req: r}, nil
+	case "json_schema":
+	default:
+		return nil, fmt.Errorf("%w: unsupported response_format type %q", ErrInvalidRequest, r.ResponseFormat.Type)
+	}
+	if r.ResponseFormat.JSONSchema == nil || len(r.ResponseFormat.JSONSchema.Schema) == 0 {
+		return nil, fmt.Errorf("%w: response_format json_schema needs a schema", ErrInvalidRequest)
+	}
+	compiler := jsonschema.NewCompiler()
+	// client schemas must not make us read files or fetch urls
+	compiler.LoadURL = func(url string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("external reference %s is not allowed", url)
+	}
+	if err := compiler.AddResource(schemaURL, bytes.NewReader(r.ResponseFormat.JSONSchema.Schema)); err != nil {
+		return nil, fmt.Errorf("%w: invalid json schema: %v", ErrInvalidRequest, err)
+	}
+	schema, err := compiler.Compile(schemaURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid json schema: %v", ErrInvalidRequest, err)
+	}
+	return &outputValidator{req: r, schema: schema}, nil
+}
+
+// Validate returns the json in text without code fences, or why it is not valid
+func (v *outputValidator) Validate(text string) (string, error) {
+	text = stripCodeFence(text)
+	var value any
+	if err := json.Unmarshal([]byte(text), &value); err != nil {
+		return "", fmt.Errorf("not valid JSON: %v", err)
+	}
+	if v.schema == nil {
+		if _, ok := value.(map[string]any); !ok {
+			return "", fmt.Errorf("not a JSON object")
+		}
+		return text, nil
+	}
+	if err := v.schema.Validate(value); err != nil {
+		return "", fmt.Errorf("does not match the schema: %v", err)
+	}
+	return text, nil
+}
+
+func stripCodeFence(text string) string {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "```") {
+		return text
+	}
+	text = strings.TrimPrefix(text, "```")
+	if newline := strings.IndexByte(text, '\n'); newline >= 0 {
+		// drop the language of the fence
+		text = text[newline+1:]
+	}
+	text = strings.TrimSuffix(strings.TrimSpace(text), "```")
+	return strings.TrimSpace(text)
+}
+
+// Enforce reads the whole answer in resp and re-prompts up to
+// STRUCTURED_OUTPUT_RETRIES times while it is not valid. The stop sequences
+// and max_tokens are applied before the answer is validated, so cutting it
+// can not break the json. Answers with tool calls are passed as they are. It
+// returns a response replaying the valid answer, nothing reaches the client
+// before it is validated.
+func (v *outputValidator) Enforce(ctx context.Context, rayChatReq RayChatRequest, resp *http.Response, st *stats.Stats) (*http.Response, error) {
+	retries := settings.Get().StructuredRetries
+	// the n choices share the backing array of the messages, the corrections
+	// of this choice must not end up in theirs
+	rayChatReq.Messages = slices.Clone(rayChatReq.Messages)
+	var account *Account
+	for attempt := 0; ; attempt++ {
+		limiter := newOutputLimiter(rayChatReq.Model, v.req.Stop, v.req.GetMaxTokens())
+		text, finishReason, err := readAll(resp.Body, limiter)
+		resp.Body.Close()
+		// the first account is released by the caller
+		if account != nil {
+			account.Release()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if v.req.UseTools() {
+			if _, calls := parseToolCalls(text); len(calls) > 0 {
+				return replayResponse(text, finishReason), nil
+			}
+		}
+		valid, err := v.Validate(text)
+		if err == nil {
+			return replayResponse(valid, finishReason), nil
+		}
+		if attempt >= retries {
+			return nil, fmt.Errorf("%w after %d attempts, last reply %v", ErrInvalidStructuredOutput, attempt+1, err)
+		}
+		Logger().WithField("request_id", st.RequestID).Warnf("structured output %v, ask again", err)
+
+		correction := fmt.Sprintf("Your reply is %v. Reply again with only the corrected JSON, without code fences or any other text.", err)
+		if reason := limiter.FinishReason(); reason != nil && *reason == "length" {
+			correction = fmt.Sprintf("Your reply was cut off after %d tokens and is %v. Reply again with only a shorter JSON, without code fences or any other text.", v.req.GetMaxTokens(), err)
+		}
+		rayChatReq.Messages = append(rayChatReq.Messages,
+			RayChatMessage{Author: "assistant", Content: Content{Text: text}},
+			RayChatMessage{Author: "user", Content: Content{Text: correction}},
+		)
+		resp, account, err = requestRaycast(ctx, rayChatReq, st)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// open returns how the extra choices are sent, their answers are enforced as
+// well. A nil validator sends them as they are.
+func (v *outputValidator) open() openFunc {
+	if v == nil {
+		return requestRaycast
+	}
+	return func(ctx context.Context, request RayChatRequest, st *stats.Stats) (*http.Response, *Account, error) {
+		resp, account, err := requestRaycast(ctx, request, st)
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp, err = v.Enforce(ctx, request, resp, st); err != nil {
+			account.Release()
+			return nil, nil, err
+		}
+		return resp, account, nil
+	}
+}
+
+// readAll reads the whole raycast stream through limiter
+func readAll(body io.Reader, limiter *outputLimiter) (string, *string, error) {
+	text := strings.Builder{}
+	var finishReason *string
+	err := readEvents(body, func(rayChatResp RayChatStreamResponse) error {
+		text.WriteString(limiter.Write(rayChatResp.Text))
+		if rayChatResp.FinishReason != nil {
+			finishReason = rayChatResp.FinishReason
+		}
+		if limiter.Done() {
+			return errLimitReached
+		}
+		return nil
+	})
+	text.WriteString(limiter.Close())
+	if limiter.FinishReason() != nil {
+		finishReason = limiter.FinishReason()
+	}
+	return text.String(), finishReason, err
+}
+
+// replayChunkSize keeps replayed events well below maxEventSize
+const replayChunkSize = 16 << 10
+
+// replayResponse is a raycast response streaming text again
+func replayResponse(text string, finishReason *string) *http.Response {
+	body := strings.Builder{}
+	runes := []rune(text)
+	for start := 0; start == 0 || start < len(runes); start += replayChunkSize {
+		end := min(start+replayChunkSize, len(runes))
+		event := RayChatStreamResponse{Text: string(runes[start:end])}
+		if end == len(runes) {
+			event.FinishReason = finishReason
+		}
+		data, _ := json.Marshal(event)
+		body.WriteString("data: " + string(data) + "\n\n")
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader(body.String())),
+	}
+}
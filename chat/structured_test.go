@@ -0,0 +1,104 @@
+package chat
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestStripCodeFence(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{name: "no fence", text: ` {"a": 1} `, want: `{"a": 1}`},
+		{name: "json fence", text: "```json\n{\"a\": 1}\n```", want: `{"a": 1}`},
+		{name: "bare fence", text: "```\n{\"a\": 1}\n```\n", want: `{"a": 1}`},
+		{name: "unclosed fence", text: "```json\n{\"a\": 1}", want: `{"a": 1}`},
+		{name: "fence on one line", text: "```{\"a\": 1}```", want: `{"a": 1}`},
+		{name: "text before the fence", text: "sure:\n```json\n{}\n```", want: "sure:\n```json\n{}\n```"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripCodeFence(tt.text); got != tt.want {
+				t.Errorf("stripCodeFence(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutputValidator(t *testing.T) {
+	schema := `{"type": "object", "properties": {"name": {"type": "string"}}, "required": ["name"]}`
+	tests := []struct {
+		name   string
+		format *ResponseFormat
+		text   string
+		want   string
+		err    string
+	}{
+		{name: "object", format: &ResponseFormat{Type: "json_object"}, text: `{"a": 1}`, want: `{"a": 1}`},
+		{name: "fenced object", format: &ResponseFormat{Type: "json_object"}, text: "```json\n{\"a\": 1}\n```", want: `{"a": 1}`},
+		{name: "array is not an object", format: &ResponseFormat{Type: "json_object"}, text: `[1]`, err: "not a JSON object"},
+		{name: "cut json", format: &ResponseFormat{Type: "json_object"}, text: `{"a": "`, err: "not valid JSON"},
+		{name: "prose", format: &ResponseFormat{Type: "json_object"}, text: "here you go", err: "not valid JSON"},
+		{name: "matches the schema", format: schemaFormat(schema), text: `{"name": "raychat"}`, want: `{"name": "raychat"}`},
+		{name: "array matches its schema", format: schemaFormat(`{"type": "array"}`), text: `[1, 2]`, want: `[1, 2]`},
+		{name: "missing property", format: schemaFormat(schema), text: `{"other": 1}`, err: "does not match the schema"},
+		{name: "wrong type", format: schemaFormat(schema), text: `{"name": 1}`, err: "does not match the schema"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := newOutputValidator(OpenAIRequest{ResponseFormat: tt.format})
+			if err != nil {
+				t.Fatalf("newOutputValidator: %v", err)
+			}
+			got, err := v.Validate(tt.text)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("Validate(%q) error = %v, want %q", tt.text, err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("Validate(%q) = %q, %v, want %q", tt.text, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewOutputValidator(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  *ResponseFormat
+		enabled bool
+		invalid bool
+	}{
+		{name: "no format"},
+		{name: "text", format: &ResponseFormat{Type: "text"}},
+		{name: "json object", format: &ResponseFormat{Type: "json_object"}, enabled: true},
+		{name: "json schema", format: schemaFormat(`{"type": "object"}`), enabled: true},
+		{name: "unknown type", format: &ResponseFormat{Type: "xml"}, invalid: true},
+		{name: "schema missing", format: &ResponseFormat{Type: "json_schema"}, invalid: true},
+		{name: "broken schema", format: schemaFormat(`{"type": 1}`), invalid: true},
+		{name: "external reference", format: schemaFormat(`{"$ref": "https://example.com/schema.json"}`), invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := newOutputValidator(OpenAIRequest{ResponseFormat: tt.format})
+			if tt.invalid {
+				if !errors.Is(err, ErrInvalidRequest) {
+					t.Errorf("error = %v, want ErrInvalidRequest", err)
+				}
+				return
+			}
+			if err != nil || (v != nil) != tt.enabled {
+				t.Errorf("validator = %v, %v, want enabled %v", v, err, tt.enabled)
+			}
+		})
+	}
+}
+
+func schemaFormat(schema string) *ResponseFormat {
+	return &ResponseFormat{Type: "json_schema", JSONSchema: &JSONSchemaFormat{Name: "test", Schema: []byte(schema)}}
+}
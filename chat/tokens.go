@@ -0,0 +1,38 @@
+package chat
+
+import "raychat/tokenizer"
+
+// tokens added by the chat format around every message and to prime the reply
+const (
+	tokensPerMessage = 3
+	tokensPerReply   = 3
+)
+
+func countTokens(model, text string) int {
+	return tokenizer.Count(model, text)
+}
+
+// truncateTokens returns the longest prefix of text within n tokens
+func truncateTokens(model, text string, n int) string {
+	return tokenizer.Truncate(model, text, n)
+}
+
+// PromptTokens counts the tokens of the system instructions and messages sent to raycast
+func (r RayChatRequest) PromptTokens() int {
+	tokens := tokensPerReply
+	if r.AdditionalSystemInstructions != "" {
+		tokens += tokensPerMessage + countTokens(r.Model, r.AdditionalSystemInstructions)
+	}
+	for _, m := range r.Messages {
+		tokens += tokensPerMessage + countTokens(r.Model, m.Content.Text)
+	}
+	return tokens
+}
+
+func newUsage(promptTokens, completionTokens int) Usage {
+	return Usage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      promptTokens + completionTokens,
+	}
+}
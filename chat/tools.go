@@ -0,0 +1,286 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/samber/lo"
+)
+
+// raycast has no native tool calling, tools are described in the system
+// instructions and the model is asked to answer with tagged json blocks
+const (
+	toolCallOpen    = "<tool_call>"
+	toolCallClose   = "</tool_call>"
+	toolResultOpen  = "<tool_result"
+	toolResultClose = "</tool_result>"
+)
+
+type Tool struct {
+	Type     string             `json:"type"`
+	Function FunctionDefinition `json:"function"`
+}
+
+type FunctionDefinition struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+type ToolCall struct {
+	Index    *int         `json:"index,omitempty"`
+	ID       string       `json:"id"`
+	Type     string       `json:"type"`
+	Function FunctionCall `json:"function"`
+}
+
+type FunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// toolChoice is the parsed tool_choice or legacy function_call, it is either
+// "auto", "none", "required" or a function name the model is forced to call
+type toolChoice struct {
+	Mode     string
+	Function string
+}
+
+func parseToolChoice(raw json.RawMessage) toolChoice {
+	if len(raw) == 0 || string(raw) == "null" {
+		return toolChoice{Mode: "auto"}
+	}
+	var mode string
+	if err := json.Unmarshal(raw, &mode); err == nil {
+		return toolChoice{Mode: mode}
+	}
+	var named struct {
+		Name     string `json:"name"`
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(raw, &named); err == nil {
+		if named.Function.Name != "" {
+			return toolChoice{Mode: "function", Function: named.Function.Name}
+		}
+		if named.Name != "" {
+			return toolChoice{Mode: "function", Function: named.Name}
+		}
+	}
+	return toolChoice{Mode: "auto"}
+}
+
+// GetTools returns the tools of the request, legacy functions are turned into tools
+func (r OpenAIRequest) GetTools() []Tool {
+	tools := append([]Tool{}, r.Tools...)
+	for _, f := range r.Functions {
+		tools = append(tools, Tool{Type: "function", Function: f})
+	}
+	return tools
+}
+
+func (r OpenAIRequest) GetToolChoice() toolChoice {
+	if len(r.Tools) == 0 && len(r.Functions) > 0 {
+		return parseToolChoice(r.FunctionCall)
+	}
+	return parseToolChoice(r.ToolChoice)
+}
+
+// UseTools reports whether the model may call tools for this request
+func (r OpenAIRequest) UseTools() bool {
+	return len(r.GetTools()) > 0 && r.GetToolChoice().Mode != "none"
+}
+
+// LegacyFunctions reports whether the client uses the deprecated functions api
+func (r OpenAIRequest) LegacyFunctions() bool {
+	return len(r.Tools) == 0 && len(r.Functions) > 0
+}
+
+func (r OpenAIRequest) toolInstructions() string {
+	tools := r.GetTools()
+	definitions := make([]FunctionDefinition, 0, len(tools))
+	for _, t := range tools {
+		definitions = append(definitions, t.Function)
+	}
+	rawDefinitions, err := json.MarshalIndent(definitions, "", "  ")
+	if err != nil {
+		rawDefinitions = []byte("[]")
+	}
+
+	b := strings.Builder{}
+	b.WriteString("You have access to the following tools, described as JSON with their parameters as JSON Schema:\n")
+	b.Write(rawDefinitions)
+	b.WriteString("\n\nTo call a tool, reply with one block per call in exactly this format:\n")
+	b.WriteString(toolCallOpen + `{"name": "<tool name>", "arguments": {<arguments as a JSON object>}}` + toolCallClose + "\n")
+	b.WriteString("When you call tools, reply with the blocks only and wait for the results. ")
+	b.WriteString("Tool results are given back in " + toolResultOpen + "> blocks, use them to answer the user.\n")
+	switch choice := r.GetToolChoice(); choice.Mode {
+	case "required":
+		b.WriteString("You must call at least one tool now.\n")
+	case "function":
+		b.WriteString(fmt.Sprintf("You must call the tool %q now.\n", choice.Function))
+	default:
+		b.WriteString("Only call a tool when it is needed, otherwise answer normally.\n")
+	}
+	return b.String()
+}
+
+// toolCallsToText renders the tool calls of an assistant message the way the model is asked to write them
+func toolCallsToText(calls []ToolCall) string {
+	b := strings.Builder{}
+	for _, call := range calls {
+		arguments := call.Function.Arguments
+		if !json.Valid([]byte(arguments)) {
+			rawArguments, _ := json.Marshal(arguments)
+			arguments = string(rawArguments)
+		}
+		rawName, _ := json.Marshal(call.Function.Name)
+		b.WriteString(toolCallOpen + `{"name": ` + string(rawName) + `, "arguments": ` + arguments + "}" + toolCallClose + "\n")
+	}
+	return b.String()
+}
+
+func toolResultToText(id, name, content string) string {
+	attrs := ""
+	if id != "" {
+		attrs += fmt.Sprintf(" id=%q", id)
+	}
+	if name != "" {
+		attrs += fmt.Sprintf(" name=%q", name)
+	}
+	return toolResultOpen + attrs + ">" + content + toolResultClose
+}
+
+// parseToolCalls extracts the tool call blocks from text and returns the remaining content
+func parseToolCalls(text string) (string, []ToolCall) {
+	content := strings.Builder{}
+	calls := []ToolCall{}
+	rest := text
+	for {
+		start := strings.Index(rest, toolCallOpen)
+		if start < 0 {
+			content.WriteString(rest)
+			break
+		}
+		content.WriteString(rest[:start])
+		body := rest[start+len(toolCallOpen):]
+		end := strings.Index(body, toolCallClose)
+		next := ""
+		if end >= 0 {
+			next = body[end+len(toolCallClose):]
+			body = body[:end]
+		}
+		call, ok := parseToolCall(body)
+		if !ok {
+			// not a valid call, keep it as it is
+			content.WriteString(rest[start : len(rest)-len(next)])
+		} else {
+			calls = append(calls, call)
+		}
+		if end < 0 {
+			break
+		}
+		rest = next
+	}
+	return strings.TrimSpace(content.String()), calls
+}
+
+func parseToolCall(body string) (ToolCall, bool) {
+	body = strings.TrimSpace(body)
+	body = strings.TrimPrefix(body, "```json")
+	body = strings.Trim(body, "`\n ")
+	var raw struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	}
+	if err := json.Unmarshal([]byte(body), &raw); err != nil || raw.Name == "" {
+		return ToolCall{}, false
+	}
+	arguments := "{}"
+	if len(raw.Arguments) > 0 {
+		var s string
+		if err := json.Unmarshal(raw.Arguments, &s); err == nil {
+			arguments = s
+		} else {
+			compacted := bytes.Buffer{}
+			if err := json.Compact(&compacted, raw.Arguments); err == nil {
+				arguments = compacted.String()
+			}
+		}
+	}
+	return ToolCall{
+		ID:   "call_" + generateRandomString(24),
+		Type: "function",
+		Function: FunctionCall{
+			Name:      raw.Name,
+			Arguments: arguments,
+		},
+	}, true
+}
+
+// toolCallStream passes streamed text through until a tool call may start,
+// everything from there on is held back and parsed once the stream ends
+type toolCallStream struct {
+	pending   string
+	capturing bool
+}
+
+func (s *toolCallStream) Write(text string) string {
+	s.pending += text
+	if s.capturing {
+		return ""
+	}
+	if idx := strings.Index(s.pending, toolCallOpen); idx >= 0 {
+		emit := s.pending[:idx]
+		s.pending = s.pending[idx:]
+		s.capturing = true
+		return emit
+	}
+	keep := partialSuffix(s.pending, toolCallOpen)
+	emit := s.pending[:len(s.pending)-keep]
+	s.pending = s.pending[len(s.pending)-keep:]
+	return emit
+}
+
+func (s *toolCallStream) Close() (string, []ToolCall) {
+	if !s.capturing {
+		return s.pending, nil
+	}
+	content, calls := parseToolCalls(s.pending)
+	return content, calls
+}
+
+// partialSuffix returns the length of the longest suffix of text that is a proper prefix of marker
+func partialSuffix(text, marker string) int {
+	for n := len(marker) - 1; n > 0; n-- {
+		if strings.HasSuffix(text, marker[:n]) {
+			return n
+		}
+	}
+	return 0
+}
+
+// toolCallsMessage fills the parsed tool calls into msg the way the client asked for them
+func (r OpenAIRequest) toolCallsMessage(msg OpenAIMessage, calls []ToolCall) (OpenAIMessage, string) {
+	if r.LegacyFunctions() {
+		msg.FunctionCall = &calls[0].Function
+		return msg, "function_call"
+	}
+	msg.ToolCalls = calls
+	return msg, "tool_calls"
+}
+
+func (r OpenAIRequest) toolCallsDelta(calls []ToolCall) (Delta, string) {
+	if r.LegacyFunctions() {
+		return Delta{FunctionCall: &calls[0].Function}, "function_call"
+	}
+	indexed := make([]ToolCall, 0, len(calls))
+	for i, call := range calls {
+		call.Index = lo.ToPtr(i)
+		indexed = append(indexed, call)
+	}
+	return Delta{ToolCalls: indexed}, "tool_calls"
+}
@@ -0,0 +1,136 @@
+package chat
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseToolCalls(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		content string
+		calls   []FunctionCall
+	}{
+		{
+			name:    "plain text",
+			text:    "hello there",
+			content: "hello there",
+		},
+		{
+			name:    "single call",
+			text:    `<tool_call>{"name": "get_weather", "arguments": {"city": "Paris"}}</tool_call>`,
+			content: "",
+			calls:   []FunctionCall{{Name: "get_weather", Arguments: `{"city":"Paris"}`}},
+		},
+		{
+			name:    "text around calls",
+			text:    "let me check <tool_call>{\"name\":\"a\"}</tool_call> and <tool_call>{\"name\":\"b\",\"arguments\":\"{\\\"x\\\":1}\"}</tool_call> done",
+			content: "let me check  and  done",
+			calls:   []FunctionCall{{Name: "a", Arguments: "{}"}, {Name: "b", Arguments: `{"x":1}`}},
+		},
+		{
+			name:    "fenced json",
+			text:    "<tool_call>\n```json\n{\"name\": \"a\", \"arguments\": {}}\n```\n</tool_call>",
+			content: "",
+			calls:   []FunctionCall{{Name: "a", Arguments: "{}"}},
+		},
+		{
+			name:    "unclosed call",
+			text:    `before <tool_call>{"name": "a"}`,
+			content: "before",
+			calls:   []FunctionCall{{Name: "a", Arguments: "{}"}},
+		},
+		{
+			name:    "invalid call is kept",
+			text:    "before <tool_call>not json</tool_call> after",
+			content: "before <tool_call>not json</tool_call> after",
+		},
+		{
+			name:    "call without name is kept",
+			text:    `<tool_call>{"arguments": {}}</tool_call>`,
+			content: `<tool_call>{"arguments": {}}</tool_call>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content, calls := parseToolCalls(tt.text)
+			if content != tt.content {
+				t.Errorf("content = %q, want %q", content, tt.content)
+			}
+			checkToolCalls(t, calls, tt.calls)
+		})
+	}
+}
+
+func TestToolCallStream(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		emitted string
+		content string
+		calls   []FunctionCall
+	}{
+		{
+			name:    "plain text",
+			text:    "hello <tool world",
+			emitted: "hello <tool world",
+		},
+		{
+			name:    "text ending like a marker",
+			text:    "hello <tool_ca",
+			emitted: "hello ",
+			content: "<tool_ca",
+		},
+		{
+			name:    "call after text",
+			text:    `sure <tool_call>{"name": "a", "arguments": {"x": 1}}</tool_call>`,
+			emitted: "sure ",
+			calls:   []FunctionCall{{Name: "a", Arguments: `{"x":1}`}},
+		},
+		{
+			name:    "text after call is held back",
+			text:    `<tool_call>{"name": "a"}</tool_call> done`,
+			content: "done",
+			calls:   []FunctionCall{{Name: "a", Arguments: "{}"}},
+		},
+	}
+	for _, tt := range tests {
+		// split the text at every position so markers straddle chunk boundaries
+		for i := 0; i <= len(tt.text); i++ {
+			s := &toolCallStream{}
+			emitted := s.Write(tt.text[:i]) + s.Write(tt.text[i:])
+			content, calls := s.Close()
+			if emitted != tt.emitted || content != tt.content {
+				t.Errorf("%s split at %d: emitted %q and closed with %q, want %q and %q", tt.name, i, emitted, content, tt.emitted, tt.content)
+			}
+			checkToolCalls(t, calls, tt.calls)
+		}
+
+		s := &toolCallStream{}
+		emitted := strings.Builder{}
+		for _, r := range tt.text {
+			emitted.WriteString(s.Write(string(r)))
+		}
+		content, calls := s.Close()
+		if emitted.String() != tt.emitted || content != tt.content {
+			t.Errorf("%s byte by byte: emitted %q and closed with %q, want %q and %q", tt.name, emitted.String(), content, tt.emitted, tt.content)
+		}
+		checkToolCalls(t, calls, tt.calls)
+	}
+}
+
+func checkToolCalls(t *testing.T, calls []ToolCall, want []FunctionCall) {
+	t.Helper()
+	if len(calls) != len(want) {
+		t.Fatalf("got %d tool calls, want %d", len(calls), len(want))
+	}
+	for i, call := range calls {
+		if call.Function != want[i] {
+			t.Errorf("call %d = %+v, want %+v", i, call.Function, want[i])
+		}
+		if call.Type != "function" || !strings.HasPrefix(call.ID, "call_") {
+			t.Errorf("call %d has type %q and id %q", i, call.Type, call.ID)
+		}
+	}
+}
@@ -2,7 +2,7 @@ package chat
 
 import (
 	"encoding/json"
-	"raychat/auth"
+	"fmt"
 	"strings"
 	"time"
 
@@ -10,25 +10,72 @@ import (
 )
 
 type OpenAIRequest struct {
-	Model       string          `json:"model"`
-	Messages    []OpenAIMessage `json:"messages"`
-	Stream      bool            `json:"stream"`
-	Temperature float64         `json:"temperature"`
+	Model               string               `json:"model"`
+	Messages            []OpenAIMessage      `json:"messages"`
+	Stream              bool                 `json:"stream"`
+	Temperature         float64              `json:"temperature"`
+	MaxTokens           int                  `json:"max_tokens"`
+	MaxCompletionTokens int                  `json:"max_completion_tokens"`
+	Stop                StopSequences        `json:"stop"`
+	StreamOptions       *StreamOptions       `json:"stream_options"`
+	Tools               []Tool               `json:"tools"`
+	ToolChoice          json.RawMessage      `json:"tool_choice"`
+	Functions           []FunctionDefinition `json:"functions"`
+	FunctionCall        json.RawMessage      `json:"function_call"`
+	ResponseFormat      *ResponseFormat      `json:"response_format"`
+	N                   int                  `json:"n"`
 }
 
-func (r OpenAIRequest) ToRayChatRequest(a *auth.RaycastAuth) RayChatRequest {
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// IncludeUsage reports whether a usage chunk is sent at the end of the stream
+func (r OpenAIRequest) IncludeUsage() bool {
+	return r.StreamOptions != nil && r.StreamOptions.IncludeUsage
+}
+
+// GetMaxTokens returns the completion token budget, 0 means unlimited
+func (r OpenAIRequest) GetMaxTokens() int {
+	if r.MaxCompletionTokens > 0 {
+		return r.MaxCompletionTokens
+	}
+	return r.MaxTokens
+}
+
+func (r OpenAIRequest) ToRayChatRequest() (RayChatRequest, error) {
 	messages := make([]RayChatMessage, 0, len(r.Messages))
+	toolNames := map[string]string{}
 	for _, m := range r.Messages {
-		if m.Role == "system" {
+		switch m.Role {
+		case "system":
+			continue
+		case "tool":
+			messages = append(messages, RayChatMessage{
+				Content: Content{Text: toolResultToText(m.ToolCallID, toolNames[m.ToolCallID], m.Content)},
+				Author:  "user",
+			})
+			continue
+		case "function":
+			messages = append(messages, RayChatMessage{
+				Content: Content{Text: toolResultToText("", m.Name, m.Content)},
+				Author:  "user",
+			})
 			continue
 		}
+		for _, call := range m.ToolCalls {
+			toolNames[call.ID] = call.Function.Name
+		}
 		messages = append(messages, m.ToRayChatMessage())
 	}
 	if r.Temperature == 0 {
 		r.Temperature = 1
 	}
 
-	model, provider := r.GetRequestModel(a)
+	model, provider, err := r.GetRequestModel()
+	if err != nil {
+		return RayChatRequest{}, err
+	}
 
 	resp := RayChatRequest{
 		Debug:             false,
@@ -41,27 +88,23 @@ func (r OpenAIRequest) ToRayChatRequest(a *auth.RaycastAuth) RayChatRequest {
 	}
 
 	additionalSystemInstructions := r.GetSystemMessage().Content
+	if r.UseTools() {
+		additionalSystemInstructions = strings.TrimSpace(additionalSystemInstructions + "\n\n" + r.toolInstructions())
+	}
+	if r.UseJSON() {
+		// the markdown instruction makes models fence their json
+		resp.SystemInstruction = ""
+		additionalSystemInstructions = strings.TrimSpace(additionalSystemInstructions + "\n\n" + r.responseFormatInstructions())
+	}
 	if additionalSystemInstructions != "" {
 		resp.AdditionalSystemInstructions = additionalSystemInstructions
 	}
 
-	return resp
+	return resp, resp.checkVision()
 }
 
-func (r OpenAIRequest) GetRequestModel(a *auth.RaycastAuth) (string, string) {
-	model := r.Model
-	supporedModels := lo.Keys(models)
-	for _, m := range a.LoginResp.User.AiChatModels {
-		supporedModels = append(supporedModels, m.Model)
-	}
-	if a.LoginResp.User.EligibleForGpt4 {
-		supporedModels = append(supporedModels, "gpt-4")
-	}
-
-	if !lo.Contains(supporedModels, r.Model) {
-		model = "gpt-3.5-turbo"
-	}
-	return model, models[model]
+func (r OpenAIRequest) GetRequestModel() (string, string, error) {
+	return resolveModel(r.Model)
 }
 
 func (r OpenAIRequest) GetSystemMessage() OpenAIMessage {
@@ -100,7 +143,8 @@ type RayChatRequest struct {
 }
 
 type Content struct {
-	Text string `json:"text"`
+	Text        string              `json:"text"`
+	Attachments []RayChatAttachment `json:"attachments,omitempty"`
 }
 
 type RayChatMessage struct {
@@ -121,20 +165,20 @@ type RayChatStreamResponse struct {
 	Err          interface{} `json:"error"`
 }
 
-func (r RayChatStreamResponse) FromEventString(origin string) RayChatStreamResponse {
+func (r RayChatStreamResponse) FromEventString(origin string) (RayChatStreamResponse, error) {
 	selection := strings.Replace(origin, "data: ", "", 1)
 	if len(selection) == 0 {
-		return RayChatStreamResponse{}
+		return RayChatStreamResponse{}, nil
 	}
 	err := json.Unmarshal([]byte(selection), &r)
 	if err != nil {
-		panic(err)
+		return RayChatStreamResponse{}, fmt.Errorf("%w: %v, event: %s", ErrBadUpstreamPayload, err, origin)
 	}
-	if strings.Contains(selection, "error") {
-		Logger().WithError(err).Errorf("request to raycast error, body: %+v", origin)
-		return RayChatStreamResponse{}
+	if r.Err != nil {
+		Logger().Errorf("request to raycast error, body: %+v", origin)
+		return RayChatStreamResponse{}, fmt.Errorf("%w: %v", ErrUpstreamUnavailable, r.Err)
 	}
-	return r
+	return r, nil
 }
 
 func (r RayChatStreamResponse) ToOpenAISteamResponse(model string) OpenAIStreamResponse {
@@ -162,7 +206,7 @@ func (r RayChatStreamResponse) ToOpenAISteamResponse(model string) OpenAIStreamR
 
 type RayChatStreamResponses []RayChatStreamResponse
 
-func (r RayChatStreamResponses) ToOpenAIResponse(model string) OpenAIResponse {
+func (r RayChatStreamResponses) ToOpenAIResponse(model string, promptTokens int) OpenAIResponse {
 	content := ""
 	for _, resp := range r {
 		content += resp.Text
@@ -171,6 +215,7 @@ func (r RayChatStreamResponses) ToOpenAIResponse(model string) OpenAIResponse {
 		ID:      "chatcmpl-" + generateRandomString(29),
 		Object:  "chat.completion",
 		Created: int(time.Now().Unix()),
+		Model:   model,
 		Choices: []Choices{
 			{
 				Index: 0,
@@ -181,11 +226,7 @@ func (r RayChatStreamResponses) ToOpenAIResponse(model string) OpenAIResponse {
 				FinishReason: lo.ToPtr("stop"),
 			},
 		},
-		Usage: Usage{
-			PromptTokens:     0,
-			CompletionTokens: 0,
-			TotalTokens:      0,
-		},
+		Usage: newUsage(promptTokens, countTokens(model, content)),
 	}
 }
 
@@ -193,21 +234,28 @@ type OpenAIResponse struct {
 	ID      string    `json:"id"`
 	Object  string    `json:"object"`
 	Created int       `json:"created"`
+	Model   string    `json:"model"`
 	Choices []Choices `json:"choices"`
 	Usage   Usage     `json:"usage"`
 }
 
-func (o OpenAIResponse) ToEventString() string {
+func (o OpenAIResponse) ToEventString() (string, error) {
 	bytesRsp, err := json.Marshal(o)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
-	return "data: " + string(bytesRsp)
+	return "data: " + string(bytesRsp), nil
 }
 
 type OpenAIMessage struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role         string        `json:"role"`
+	Content      string        `json:"content"`
+	Name         string        `json:"name,omitempty"`
+	ToolCalls    []ToolCall    `json:"tool_calls,omitempty"`
+	ToolCallID   string        `json:"tool_call_id,omitempty"`
+	FunctionCall *FunctionCall `json:"function_call,omitempty"`
+	// Images are the image_url parts of the content
+	Images []string `json:"-"`
 }
 
 func (m OpenAIMessage) ToRayChatMessage() RayChatMessage {
@@ -215,9 +263,22 @@ func (m OpenAIMessage) ToRayChatMessage() RayChatMessage {
 	if m.Role == "system" {
 		role = "user"
 	}
+	text := m.Content
+	calls := m.ToolCalls
+	if m.FunctionCall != nil {
+		calls = append(calls, ToolCall{Type: "function", Function: *m.FunctionCall})
+	}
+	if len(calls) > 0 {
+		text = strings.TrimSpace(text + "\n" + toolCallsToText(calls))
+	}
+	attachments := make([]RayChatAttachment, 0, len(m.Images))
+	for _, url := range m.Images {
+		attachments = append(attachments, RayChatAttachment{Type: "image", url: url})
+	}
 	return RayChatMessage{
 		Content: Content{
-			Text: m.Content,
+			Text:        text,
+			Attachments: attachments,
 		},
 		Author: role,
 	}
@@ -241,18 +302,22 @@ type OpenAIStreamResponse struct {
 	Created int             `json:"created"`
 	Model   string          `json:"model"`
 	Choices []StreamChoices `json:"choices"`
+	Usage   *Usage          `json:"usage,omitempty"`
 }
 
-func (o OpenAIStreamResponse) ToEventString() string {
+func (o OpenAIStreamResponse) ToEventString() (string, error) {
 	bytesRsp, err := json.Marshal(o)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
-	return "data: " + string(bytesRsp)
+	return "data: " + string(bytesRsp), nil
 }
 
 type Delta struct {
-	Content string `json:"content,omitempty"`
+	Role         string        `json:"role,omitempty"`
+	Content      string        `json:"content,omitempty"`
+	ToolCalls    []ToolCall    `json:"tool_calls,omitempty"`
+	FunctionCall *FunctionCall `json:"function_call,omitempty"`
 }
 
 type StreamChoices struct {
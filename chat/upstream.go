@@ -0,0 +1,174 @@
+package chat
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"raychat/metrics"
+	"raychat/settings"
+	"raychat/stats"
+	"strconv"
+	"time"
+)
+
+// maxEventSize bounds a single raycast stream event
+const maxEventSize = 1 << 20
+
+// requestRaycast sends request with an account able to serve its model, non 200
+// responses are turned into typed errors. Connection errors, 429 and 5xx are
+// retried with another pick of the account, nothing has been streamed to the
+// client at that point. The model, account and upstream timings are recorded in
+// st. Callers must Release the account and close the response body, the upstream
+// request is aborted once ctx is done.
+func requestRaycast(ctx context.Context, request RayChatRequest, st *stats.Stats) (*http.Response, *Account, error) {
+	conf := settings.Get()
+	for attempt := 0; ; attempt++ {
+		r, account, status, retryAfter, err := sendRaycast(ctx, request, st)
+		if err == nil || attempt >= conf.UpstreamRetries || !retryable(status, err) {
+			return r, account, err
+		}
+		wait := retryBackoff(attempt, conf.UpstreamRetryBackoff)
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		if wait > conf.UpstreamRetryMaxWait {
+			return nil, nil, err
+		}
+		reason := "error"
+		if status != 0 {
+			reason = strconv.Itoa(status)
+		}
+		metrics.UpstreamRetries.WithLabelValues(st.Account, reason).Inc()
+		Logger().WithError(err).Warnf("request to raycast failed, retry %d/%d in %s", attempt+1, conf.UpstreamRetries, wait)
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// sendRaycast makes a single attempt of requestRaycast, it returns the raycast
+// status, 0 if there was no response, and how long raycast asked us to wait
+func sendRaycast(ctx context.Context, request RayChatRequest, st *stats.Stats) (*http.Response, *Account, int, time.Duration, error) {
+	st.Model = request.Model
+	account, err := getPool().Pick(ctx, request.Model)
+	if err != nil {
+		return nil, nil, 0, 0, fmt.Errorf("%w: %s", err, request.Model)
+	}
+	st.Account = account.Name
+
+	token := account.Token()
+	start := time.Now()
+	r, err := account.Cli(token).Chat(ctx, request)
+	st.UpstreamLatency = time.Since(start)
+	if err != nil {
+		account.Release()
+		if errors.Is(err, context.Canceled) {
+			// the client went away, the account is fine
+			return nil, nil, 0, 0, err
+		}
+		metrics.UpstreamLatency.WithLabelValues(metrics.ModelLabel(request.Model), account.Name, "error").Observe(st.UpstreamLatency.Seconds())
+		getPool().Report(account, token, http.StatusBadGateway)
+		if errors.Is(err, ErrUpstreamUnavailable) {
+			return nil, nil, 0, 0, err
+		}
+		return nil, nil, 0, 0, fmt.Errorf("%w: %v", ErrUpstreamUnavailable, err)
+	}
+	metrics.UpstreamLatency.WithLabelValues(metrics.ModelLabel(request.Model), account.Name, strconv.Itoa(r.StatusCode)).Observe(st.UpstreamLatency.Seconds())
+	getPool().Report(account, token, r.StatusCode)
+	if r.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(r.Body)
+		r.Body.Close()
+		account.Release()
+		account.Logger().Errorf("request to raycast error, status: %d, body: %+v", r.StatusCode, string(data))
+		return nil, nil, r.StatusCode, parseRetryAfter(r.Header.Get("Retry-After")), upstreamStatusError(r.StatusCode, data)
+	}
+	r.Body = &firstByteReader{ReadCloser: r.Body, onFirstByte: func() {
+		st.TimeToFirstToken = time.Since(start)
+		metrics.TimeToFirstToken.WithLabelValues(metrics.ModelLabel(request.Model), account.Name).Observe(st.TimeToFirstToken.Seconds())
+	}}
+	return r, account, r.StatusCode, 0, nil
+}
+
+// retryable reports whether a failed attempt is worth another try, status is 0
+// if raycast could not be reached
+func retryable(status int, err error) bool {
+	switch {
+	case status == http.StatusTooManyRequests || status >= 500:
+		return true
+	case status != 0:
+		return false
+	}
+	return errors.Is(err, ErrUpstreamUnavailable) && !errors.Is(err, ErrCircuitOpen)
+}
+
+// retryBackoff doubles base with every attempt, with jitter so retries of
+// concurrent requests do not arrive at once
+func retryBackoff(attempt int, base time.Duration) time.Duration {
+	d := base << attempt
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an http date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// firstByteReader calls onFirstByte once the first bytes of the stream arrived
+type firstByteReader struct {
+	io.ReadCloser
+	onFirstByte func()
+}
+
+func (r *firstByteReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 && r.onFirstByte != nil {
+		r.onFirstByte()
+		r.onFirstByte = nil
+	}
+	return n, err
+}
+
+// readEvents calls fn with every raycast stream event in body until the body
+// ends, an event is malformed or fn returns an error. fn returns errLimitReached
+// to stop reading early without failing.
+func readEvents(body io.Reader, fn func(RayChatStreamResponse) error) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), maxEventSize)
+	for scanner.Scan() {
+		event := scanner.Text()
+		if len(event) == 0 {
+			continue
+		}
+		rayChatResp, err := RayChatStreamResponse{}.FromEventString(event)
+		if err != nil {
+			return err
+		}
+		if err := fn(rayChatResp); errors.Is(err, errLimitReached) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, ErrUpstreamUnavailable) {
+			return fmt.Errorf("read stream: %w", err)
+		}
+		return fmt.Errorf("%w: read stream: %v", ErrUpstreamUnavailable, err)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		err    error
+		want   bool
+	}{
+		{name: "rate limited", status: http.StatusTooManyRequests, want: true},
+		{name: "server error", status: http.StatusBadGateway, want: true},
+		{name: "bad request", status: http.StatusBadRequest},
+		{name: "unauthorized", status: http.StatusUnauthorized},
+		{name: "payment required", status: http.StatusPaymentRequired},
+		{name: "connection error", err: fmt.Errorf("%w: dial tcp: connection refused", ErrUpstreamUnavailable), want: true},
+		{name: "open circuit", err: fmt.Errorf("account a: %w", ErrCircuitOpen)},
+		{name: "other error", err: errors.New("boom")},
+		{name: "canceled", err: fmt.Errorf("%w: context canceled", ErrInvalidRequest)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryable(tt.status, tt.err); got != tt.want {
+				t.Errorf("retryable(%d, %v) = %v, want %v", tt.status, tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		min   time.Duration
+		max   time.Duration
+	}{
+		{name: "empty", value: ""},
+		{name: "seconds", value: "3", min: 3 * time.Second, max: 3 * time.Second},
+		{name: "zero", value: "0"},
+		{name: "http date", value: time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat), min: 8 * time.Second, max: 10 * time.Second},
+		{name: "date in the past", value: "Mon, 02 Jan 2006 15:04:05 GMT", min: math.MinInt64, max: 0},
+		{name: "garbage", value: "soon"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseRetryAfter(tt.value); got < tt.min || got > tt.max {
+				t.Errorf("parseRetryAfter(%q) = %v, want between %v and %v", tt.value, got, tt.min, tt.max)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package keystore
+
+import (
+	"errors"
+
+	"github.com/gin-gonic/gin"
+)
+
+const contextKey = "raychat.key"
+
+var store *Store
+
+// Init opens the default store at file, it is opened by the server and not
+// on import so tools and tests using the packages do not create the file
+func Init(file string) error {
+	if store != nil {
+		return errors.New("key store is already open")
+	}
+	s, err := Open(file)
+	if err != nil {
+		return err
+	}
+	store = s
+	return nil
+}
+
+// Get returns the default store, Init must have been called
+func Get() *Store {
+	return store
+}
+
+// SetContext records the key that authenticated the request
+func SetContext(c *gin.Context, k Key) {
+	c.Set(contextKey, k)
+}
+
+// FromContext returns the key that authenticated the request, static
+// EXTERNAL_TOKEN tokens and unauthenticated requests have none
+func FromContext(c *gin.Context) (Key, bool) {
+	v, ok := c.Get(contextKey)
+	if !ok {
+		return Key{}, false
+	}
+	k, ok := v.(Key)
+	return k, ok
+}
@@ -0,0 +1,266 @@
+package keystore
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path"
+	"path/filepath"
+	"raychat/settings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	ErrNotFound = errors.New("api key not found")
+	ErrDisabled = errors.New("api key disabled")
+	ErrExpired  = errors.New("api key expired")
+)
+
+var (
+	keysBucket   = []byte("keys")
+	hashesBucket = []byte("hashes")
+)
+
+const (
+	secretPrefix = "sk-"
+	secretLength = 48
+	charset      = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+)
+
+func Logger() *logrus.Entry {
+	return logrus.WithField("prefix", "keystore")
+}
+
+// Key is an api key given to a client, only the sha256 of the secret is stored
+type Key struct {
+	ID        string           `json:"id"`
+	Name      string           `json:"name"`
+	Hash      string           `json:"-"`
+	Prefix    string           `json:"prefix"`
+	CreatedAt time.Time        `json:"created_at"`
+	ExpiresAt *time.Time       `json:"expires_at,omitempty"`
+	Models    []string         `json:"models,omitempty"`
+	Limits    *settings.Limits `json:"limits,omitempty"`
+	Disabled  bool             `json:"disabled"`
+}
+
+// storedKey keeps the hash, which is hidden from the admin api
+type storedKey struct {
+	Key
+	Hash string `json:"hash"`
+}
+
+// Check returns why the key can not be used, nil if it can
+func (k Key) Check() error {
+	if k.Disabled {
+		return ErrDisabled
+	}
+	if k.ExpiresAt != nil && time.Now().After(*k.ExpiresAt) {
+		return ErrExpired
+	}
+	return nil
+}
+
+// AllowsModel reports whether model is in the allowlist, glob patterns are
+// supported and an empty allowlist allows every model
+func (k Key) AllowsModel(model string) bool {
+	if len(k.Models) == 0 {
+		return true
+	}
+	for _, pattern := range k.Models {
+		if ok, _ := path.Match(pattern, model); ok || pattern == model {
+			return true
+		}
+	}
+	return false
+}
+
+type Store struct {
+	db *bolt.DB
+}
+
+func Open(file string) (*Store, error) {
+	if dir := filepath.Dir(file); dir != "." {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, err
+		}
+	}
+	db, err := bolt.Open(file, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{keysBucket, hashesBucket, usageBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Create stores a new key and returns it with its secret, the secret can not be read again
+func (s *Store) Create(k Key) (Key, string, error) {
+	secret := generateSecret()
+	k.ID = "key_" + generateRandomString(16)
+	k.CreatedAt = time.Now()
+	k.Hash = hashSecret(secret)
+	k.Prefix = secret[:len(secretPrefix)+4]
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return putKey(tx, k)
+	})
+	return k, secret, err
+}
+
+func (s *Store) Get(id string) (Key, error) {
+	var k Key
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		k, err = getKey(tx, id)
+		return err
+	})
+	return k, err
+}
+
+func (s *Store) List() ([]Key, error) {
+	keys := []Key{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(keysBucket).ForEach(func(_, v []byte) error {
+			k, err := decodeKey(v)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, k)
+			return nil
+		})
+	})
+	return keys, err
+}
+
+// Update changes the key with id in place, the id, hash and creation time are kept
+func (s *Store) Update(id string, fn func(*Key)) (Key, error) {
+	var k Key
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		k, err = getKey(tx, id)
+		if err != nil {
+			return err
+		}
+		updated := k
+		fn(&updated)
+		updated.ID, updated.Hash, updated.Prefix, updated.CreatedAt = k.ID, k.Hash, k.Prefix, k.CreatedAt
+		k = updated
+		return putKey(tx, k)
+	})
+	return k, err
+}
+
+// Rotate replaces the secret of the key with id, the old secret stops working at once
+func (s *Store) Rotate(id string) (Key, string, error) {
+	secret := generateSecret()
+	var k Key
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		k, err = getKey(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(hashesBucket).Delete([]byte(k.Hash)); err != nil {
+			return err
+		}
+		k.Hash = hashSecret(secret)
+		k.Prefix = secret[:len(secretPrefix)+4]
+		return putKey(tx, k)
+	})
+	return k, secret, err
+}
+
+func (s *Store) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		k, err := getKey(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(hashesBucket).Delete([]byte(k.Hash)); err != nil {
+			return err
+		}
+		return tx.Bucket(keysBucket).Delete([]byte(id))
+	})
+}
+
+// Lookup finds the key of secret, it does not check whether the key is usable
+func (s *Store) Lookup(secret string) (Key, error) {
+	var k Key
+	err := s.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(hashesBucket).Get([]byte(hashSecret(secret)))
+		if id == nil {
+			return ErrNotFound
+		}
+		var err error
+		k, err = getKey(tx, string(id))
+		return err
+	})
+	return k, err
+}
+
+func getKey(tx *bolt.Tx, id string) (Key, error) {
+	v := tx.Bucket(keysBucket).Get([]byte(id))
+	if v == nil {
+		return Key{}, ErrNotFound
+	}
+	return decodeKey(v)
+}
+
+func putKey(tx *bolt.Tx, k Key) error {
+	v, err := json.Marshal(storedKey{Key: k, Hash: k.Hash})
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(keysBucket).Put([]byte(k.ID), v); err != nil {
+		return err
+	}
+	return tx.Bucket(hashesBucket).Put([]byte(k.Hash), []byte(k.ID))
+}
+
+func decodeKey(v []byte) (Key, error) {
+	var sk storedKey
+	if err := json.Unmarshal(v, &sk); err != nil {
+		return Key{}, err
+	}
+	sk.Key.Hash = sk.Hash
+	return sk.Key, nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateSecret() string {
+	return secretPrefix + generateRandomString(secretLength)
+}
+
+func generateRandomString(length int) string {
+	b := make([]byte, length)
+	for i := range b {
+		n, _ := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
+		b[i] = charset[n.Int64()]
+	}
+	return string(b)
+}
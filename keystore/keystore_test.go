@@ -0,0 +1,233 @@
+package keystore
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := Open(filepath.Join(t.TempDir(), "keys.db"))
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestHashSecret(t *testing.T) {
+	tests := []struct {
+		secret string
+		hash   string
+	}{
+		{secret: "", hash: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{secret: "abc", hash: "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+	}
+	for _, tt := range tests {
+		if got := hashSecret(tt.secret); got != tt.hash {
+			t.Errorf("hashSecret(%q) = %s, want %s", tt.secret, got, tt.hash)
+		}
+	}
+}
+
+func TestCreateAndLookup(t *testing.T) {
+	s := openTestStore(t)
+	k, secret, err := s.Create(Key{Name: "ci", Models: []string{"gpt-4*"}})
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if !strings.HasPrefix(secret, secretPrefix) || len(secret) != len(secretPrefix)+secretLength {
+		t.Errorf("secret %q has the wrong shape", secret)
+	}
+	if k.Hash != hashSecret(secret) || strings.Contains(k.Hash, secret) {
+		t.Errorf("key stores %q instead of the hash of the secret", k.Hash)
+	}
+	if k.Prefix != secret[:len(secretPrefix)+4] {
+		t.Errorf("prefix = %q", k.Prefix)
+	}
+
+	tests := []struct {
+		name   string
+		secret string
+		err    error
+	}{
+		{name: "secret", secret: secret},
+		{name: "unknown secret", secret: "sk-unknown", err: ErrNotFound},
+		{name: "hash is not a secret", secret: k.Hash, err: ErrNotFound},
+		{name: "empty", secret: "", err: ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.Lookup(tt.secret)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Lookup error = %v, want %v", err, tt.err)
+			}
+			if err == nil && (got.ID != k.ID || got.Name != "ci" || got.Hash != k.Hash) {
+				t.Errorf("Lookup = %+v, want %+v", got, k)
+			}
+		})
+	}
+}
+
+func TestRotateAndDelete(t *testing.T) {
+	tests := []struct {
+		name     string
+		rotate   bool
+		delete   bool
+		oldWorks bool
+		newWorks bool
+		getErr   error
+	}{
+		{name: "untouched", oldWorks: true},
+		{name: "rotated", rotate: true, newWorks: true},
+		{name: "deleted", delete: true, getErr: ErrNotFound},
+		{name: "rotated then deleted", rotate: true, delete: true, getErr: ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := openTestStore(t)
+			k, secret, err := s.Create(Key{Name: "a"})
+			if err != nil {
+				t.Fatalf("create: %v", err)
+			}
+			other, otherSecret, _ := s.Create(Key{Name: "b"})
+
+			newSecret := ""
+			if tt.rotate {
+				rotated, rotatedSecret, err := s.Rotate(k.ID)
+				if err != nil {
+					t.Fatalf("rotate: %v", err)
+				}
+				if rotated.ID != k.ID || rotated.Hash == k.Hash || rotatedSecret == secret {
+					t.Errorf("rotate kept the secret: %+v", rotated)
+				}
+				newSecret = rotatedSecret
+			}
+			if tt.delete {
+				if err := s.Delete(k.ID); err != nil {
+					t.Fatalf("delete: %v", err)
+				}
+			}
+
+			if _, err := s.Lookup(secret); (err == nil) != tt.oldWorks {
+				t.Errorf("old secret lookup error = %v, want working %v", err, tt.oldWorks)
+			}
+			if newSecret != "" {
+				if _, err := s.Lookup(newSecret); (err == nil) != tt.newWorks {
+					t.Errorf("new secret lookup error = %v, want working %v", err, tt.newWorks)
+				}
+			}
+			if _, err := s.Get(k.ID); !errors.Is(err, tt.getErr) {
+				t.Errorf("Get error = %v, want %v", err, tt.getErr)
+			}
+			// the other key is never affected
+			if got, err := s.Lookup(otherSecret); err != nil || got.ID != other.ID {
+				t.Errorf("other key lookup = %+v, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestMissingKey(t *testing.T) {
+	s := openTestStore(t)
+	tests := []struct {
+		name string
+		fn   func() error
+	}{
+		{name: "get", fn: func() error { _, err := s.Get("key_missing"); return err }},
+		{name: "rotate", fn: func() error { _, _, err := s.Rotate("key_missing"); return err }},
+		{name: "delete", fn: func() error { return s.Delete("key_missing") }},
+		{name: "update", fn: func() error { _, err := s.Update("key_missing", func(*Key) {}); return err }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.fn(); !errors.Is(err, ErrNotFound) {
+				t.Errorf("error = %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestKeyCheck(t *testing.T) {
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	tests := []struct {
+		name string
+		key  Key
+		err  error
+	}{
+		{name: "usable", key: Key{}},
+		{name: "not expired yet", key: Key{ExpiresAt: &future}},
+		{name: "expired", key: Key{ExpiresAt: &past}, err: ErrExpired},
+		{name: "disabled", key: Key{Disabled: true, ExpiresAt: &past}, err: ErrDisabled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.key.Check(); !errors.Is(err, tt.err) {
+				t.Errorf("Check() = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestAllowsModel(t *testing.T) {
+	tests := []struct {
+		models []string
+		model  string
+		want   bool
+	}{
+		{models: nil, model: "gpt-4", want: true},
+		{models: []string{"gpt-4"}, model: "gpt-4", want: true},
+		{models: []string{"gpt-4"}, model: "gpt-4o"},
+		{models: []string{"claude-*"}, model: "claude-3-opus", want: true},
+		{models: []string{"claude-*"}, model: "gpt-4"},
+		{models: []string{"[bad"}, model: "[bad", want: true},
+	}
+	for _, tt := range tests {
+		if got := (Key{Models: tt.models}).AllowsModel(tt.model); got != tt.want {
+			t.Errorf("%v allows %s = %v, want %v", tt.models, tt.model, got, tt.want)
+		}
+	}
+}
+
+func TestUsage(t *testing.T) {
+	s := openTestStore(t)
+	day := time.Date(2025, 3, 31, 23, 0, 0, 0, time.UTC)
+	adds := []struct {
+		subject string
+		tokens  int
+		at      time.Time
+	}{
+		{subject: "a", tokens: 10, at: day},
+		{subject: "a", tokens: 5, at: day.Add(30 * time.Minute)},
+		{subject: "a", tokens: 7, at: day.Add(2 * time.Hour)},
+		{subject: "b", tokens: 100, at: day},
+	}
+	for _, add := range adds {
+		if err := s.AddUsage(add.subject, add.tokens, add.at); err != nil {
+			t.Fatalf("add usage: %v", err)
+		}
+	}
+	tests := []struct {
+		name    string
+		subject string
+		at      time.Time
+		daily   int
+		monthly int
+	}{
+		{name: "same day", subject: "a", at: day, daily: 15, monthly: 15},
+		{name: "next month", subject: "a", at: day.Add(2 * time.Hour), daily: 7, monthly: 7},
+		{name: "other subject", subject: "b", at: day, daily: 100, monthly: 100},
+		{name: "no usage", subject: "c", at: day},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			daily, monthly, err := s.Usage(tt.subject, tt.at)
+			if err != nil || daily != tt.daily || monthly != tt.monthly {
+				t.Errorf("Usage = %d, %d, %v, want %d, %d", daily, monthly, err, tt.daily, tt.monthly)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package keystore
+
+import (
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var usageBucket = []byte("usage")
+
+func usageKeys(subject string, now time.Time) (daily, monthly []byte) {
+	now = now.UTC()
+	return []byte(subject + "|d|" + now.Format("2006-01-02")), []byte(subject + "|m|" + now.Format("2006-01"))
+}
+
+// AddUsage adds tokens to the daily and monthly token usage of subject
+func (s *Store) AddUsage(subject string, tokens int, now time.Time) error {
+	daily, monthly := usageKeys(subject, now)
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(usageBucket)
+		for _, k := range [][]byte{daily, monthly} {
+			used, _ := strconv.Atoi(string(b.Get(k)))
+			if err := b.Put(k, []byte(strconv.Itoa(used+tokens))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Usage returns the tokens subject used today and this month, in UTC
+func (s *Store) Usage(subject string, now time.Time) (int, int, error) {
+	daily, monthly := usageKeys(subject, now)
+	var dailyUsed, monthlyUsed int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(usageBucket)
+		dailyUsed, _ = strconv.Atoi(string(b.Get(daily)))
+		monthlyUsed, _ = strconv.Atoi(string(b.Get(monthly)))
+		return nil
+	})
+	return dailyUsed, monthlyUsed, err
+}
@@ -0,0 +1,113 @@
+package metrics
+
+import (
+	"raychat/stats"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "raychat"
+
+var (
+	Requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_total",
+		Help:      "Requests served, by endpoint, model, account, status and stream.",
+	}, []string{"endpoint", "model", "account", "status", "stream"})
+
+	UpstreamLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_latency_seconds",
+		Help:      "Time until raycast answered a chat request with response headers.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"model", "account", "status"})
+
+	TimeToFirstToken = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_time_to_first_token_seconds",
+		Help:      "Time until the first chunk of a raycast chat stream arrived.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 10),
+	}, []string{"model", "account"})
+
+	Tokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tokens_total",
+		Help:      "Tokens sent to (in) and received from (out) raycast.",
+	}, []string{"model", "account", "direction"})
+
+	InflightStreams = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "inflight_streams",
+		Help:      "Streams currently proxied.",
+	}, []string{"model", "account"})
+
+	LoginAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "login_attempts_total",
+		Help:      "Raycast logins, kind is login or refresh and result is success or failure.",
+	}, []string{"account", "kind", "result"})
+
+	AccountEjections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "account_ejections_total",
+		Help:      "Times an account was put in cool-down.",
+	}, []string{"account"})
+
+	UpstreamRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_retries_total",
+		Help:      "Raycast requests retried, reason is the status or error of the failed attempt.",
+	}, []string{"account", "reason"})
+
+	CircuitOpens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "circuit_opens_total",
+		Help:      "Times the circuit breaker of an account opened.",
+	}, []string{"account"})
+)
+
+// knownModel reports whether model is in the raycast catalog, it is set by the
+// chat package once the accounts are loaded
+var knownModel func(model string) bool
+
+// SetModelCatalog sets how ModelLabel tells the models of the catalog apart
+func SetModelCatalog(fn func(model string) bool) {
+	knownModel = fn
+}
+
+// ModelLabel returns the model label of model, models outside the catalog are
+// counted as "unknown" so clients can not add label values
+func ModelLabel(model string) string {
+	if model == "" || (knownModel != nil && knownModel(model)) {
+		return model
+	}
+	return "unknown"
+}
+
+func Handler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.Handler())
+}
+
+// Middleware records the request and its tokens once the endpoint is done
+func Middleware(c *gin.Context) {
+	c.Next()
+
+	st := stats.FromContext(c)
+	Requests.WithLabelValues(
+		c.FullPath(),
+		ModelLabel(st.Model),
+		st.Account,
+		strconv.Itoa(c.Writer.Status()),
+		strconv.FormatBool(st.Stream),
+	).Inc()
+	if st.PromptTokens > 0 {
+		Tokens.WithLabelValues(ModelLabel(st.Model), st.Account, "in").Add(float64(st.PromptTokens))
+	}
+	if st.CompletionTokens > 0 {
+		Tokens.WithLabelValues(ModelLabel(st.Model), st.Account, "out").Add(float64(st.CompletionTokens))
+	}
+}
@@ -0,0 +1,50 @@
+package middlewares
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"raychat/audit"
+	"raychat/keystore"
+	"raychat/stats"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxAuditBody bounds the request body kept for the audit log
+const maxAuditBody = 10 << 20
+
+// Audit writes the prompt and the response of POST requests to the audit log
+// when AUDIT_LOG is set
+func Audit(c *gin.Context) {
+	if !audit.Enabled() || c.Request.Method != http.MethodPost || c.Request.Body == nil {
+		c.Next()
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(c.Request.Body, maxAuditBody))
+	c.Request.Body = io.NopCloser(io.MultiReader(bytes.NewReader(data), c.Request.Body))
+	if err != nil {
+		data = nil
+	}
+	c.Next()
+
+	st := stats.FromContext(c)
+	record := audit.Record{
+		Time:             time.Now(),
+		RequestID:        st.RequestID,
+		Path:             c.Request.URL.Path,
+		Status:           c.Writer.Status(),
+		Model:            st.Model,
+		Account:          st.Account,
+		Stream:           st.Stream,
+		PromptTokens:     st.PromptTokens,
+		CompletionTokens: st.CompletionTokens,
+		Request:          data,
+		Response:         st.Completion,
+	}
+	if key, ok := keystore.FromContext(c); ok {
+		record.Key = key.Name
+	}
+	audit.Write(record)
+}
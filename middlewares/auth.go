@@ -1,6 +1,10 @@
 package middlewares
 
 import (
+	"crypto/subtle"
+	"errors"
+	"raychat/chat"
+	"raychat/keystore"
 	"raychat/settings"
 	"strings"
 
@@ -8,22 +12,92 @@ import (
 	"github.com/samber/lo"
 )
 
+// Auth accepts the static EXTERNAL_TOKEN tokens and the keys of the key store.
+// It is on as soon as EXTERNAL_TOKEN or ADMIN_TOKEN is set, keys can only be
+// created with ADMIN_TOKEN, so revoking the last key never opens the proxy.
 func Auth(c *gin.Context) {
-	if len(settings.Get().ExternalToken) == 0 {
+	if !authEnabled(settings.Get()) {
 		c.Next()
 		return
 	}
 
+	token, ok := requestToken(c)
+	if !ok {
+		unauthorized(c, "Unauthorized")
+		return
+	}
+	if lo.Contains(settings.Get().ExternalToken, token) {
+		c.Next()
+		return
+	}
+	key, err := keystore.Get().Lookup(token)
+	if errors.Is(err, keystore.ErrNotFound) {
+		unauthorized(c, "Unauthorized")
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(500, chat.NewError(err.Error(), "server_error", "internal_error"))
+		return
+	}
+	if err := key.Check(); err != nil {
+		unauthorized(c, err.Error())
+		return
+	}
+	keystore.SetContext(c, key)
+	c.Next()
+}
+
+// authEnabled reports whether conf asks for api keys, it only depends on the config
+func authEnabled(conf settings.RayConfig) bool {
+	return len(conf.ExternalToken) != 0 || len(conf.AdminToken) != 0
+}
+
+// Admin guards the admin api with ADMIN_TOKEN, the api is disabled while it is empty
+func Admin(c *gin.Context) {
+	adminToken := settings.Get().AdminToken
+	if len(adminToken) == 0 {
+		c.AbortWithStatusJSON(404, chat.NewError("admin api is disabled, set ADMIN_TOKEN to enable it", "invalid_request_error", "not_found"))
+		return
+	}
+	token, ok := requestToken(c)
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		unauthorized(c, "Unauthorized")
+		return
+	}
+	c.Next()
+}
+
+// requestToken reads the api key from the Authorization bearer header, from
+// x-api-key as sent by anthropic clients or from the key GeminiKey found
+func requestToken(c *gin.Context) (string, bool) {
+	if apiKey := c.GetHeader("x-api-key"); len(apiKey) != 0 {
+		return apiKey, true
+	}
 	rawtoken := c.GetHeader("Authorization")
 	tokenStrlist := strings.Split(rawtoken, " ")
 	if len(tokenStrlist) != 2 || len(rawtoken) == 0 {
-		c.AbortWithStatusJSON(401, gin.H{"message": "Unauthorized"})
-		return
+		if apiKey := c.GetString(geminiKeyContext); len(apiKey) != 0 {
+			return apiKey, true
+		}
+		return "", false
 	}
-	token := tokenStrlist[1]
-	if !lo.Contains(settings.Get().ExternalToken, token) {
-		c.AbortWithStatusJSON(401, gin.H{"message": "Unauthorized"})
-		return
+	return tokenStrlist[1], true
+}
+
+const geminiKeyContext = "raychat.gemini_key"
+
+// GeminiKey takes the api key from x-goog-api-key or the key query parameter
+// the way the gemini sdks send it, only the gemini routes accept it there so
+// no other token ends up in urls
+func GeminiKey(c *gin.Context) {
+	if apiKey := c.GetHeader("x-goog-api-key"); len(apiKey) != 0 {
+		c.Set(geminiKeyContext, apiKey)
+	} else if apiKey := c.Query("key"); len(apiKey) != 0 {
+		c.Set(geminiKeyContext, apiKey)
 	}
 	c.Next()
 }
+
+func unauthorized(c *gin.Context, message string) {
+	c.AbortWithStatusJSON(401, chat.NewError(message, "invalid_request_error", "invalid_api_key"))
+}
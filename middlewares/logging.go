@@ -0,0 +1,81 @@
+package middlewares
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"raychat/keystore"
+	"raychat/stats"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// RequestID keeps the X-Request-ID of the client or generates one, it is sent
+// back in the response and recorded in the stats
+func RequestID(c *gin.Context) {
+	id := c.GetHeader(requestIDHeader)
+	if !validRequestID(id) {
+		b := make([]byte, 12)
+		rand.Read(b)
+		id = "req_" + hex.EncodeToString(b)
+	}
+	stats.FromContext(c).RequestID = id
+	c.Header(requestIDHeader, id)
+	c.Next()
+}
+
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > 128 {
+		return false
+	}
+	for _, r := range id {
+		if r < '!' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// AccessLog writes a structured entry for every request once it is done
+func AccessLog(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	st := stats.FromContext(c)
+	fields := logrus.Fields{
+		"prefix":     "access",
+		"request_id": st.RequestID,
+		"method":     c.Request.Method,
+		"path":       c.Request.URL.Path,
+		"status":     c.Writer.Status(),
+		"latency_ms": time.Since(start).Milliseconds(),
+		"client_ip":  c.ClientIP(),
+	}
+	if key, ok := keystore.FromContext(c); ok {
+		fields["key"] = key.Name
+	}
+	if st.Model != "" {
+		fields["model"] = st.Model
+		fields["account"] = st.Account
+		fields["stream"] = st.Stream
+		fields["upstream_latency_ms"] = st.UpstreamLatency.Milliseconds()
+		fields["ttft_ms"] = st.TimeToFirstToken.Milliseconds()
+		fields["prompt_tokens"] = st.PromptTokens
+		fields["completion_tokens"] = st.CompletionTokens
+	}
+	entry := logrus.WithFields(fields)
+	if len(c.Errors) > 0 {
+		entry = entry.WithField("error", c.Errors.String())
+	}
+	switch status := c.Writer.Status(); {
+	case status >= 500:
+		entry.Error("request done")
+	case status >= 400:
+		entry.Warn("request done")
+	default:
+		entry.Info("request done")
+	}
+}
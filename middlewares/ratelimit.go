@@ -0,0 +1,101 @@
+package middlewares
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"raychat/chat"
+	"raychat/keystore"
+	"raychat/ratelimit"
+	"raychat/settings"
+	"raychat/stats"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimit enforces the limits of the api key of the request, it must run after Auth
+func RateLimit(c *gin.Context) {
+	id, limits := rateLimitSubject(c)
+	if limits == (settings.Limits{}) {
+		c.Next()
+		return
+	}
+
+	ticket, decision := ratelimit.Default().Acquire(id, limits, isStreamRequest(c))
+	setRateLimitHeaders(c, decision)
+	if decision.Err != nil {
+		errType, code := "requests", "rate_limit_exceeded"
+		if errors.Is(decision.Err, ratelimit.ErrQuotaExceeded) {
+			errType, code = "insufficient_quota", "insufficient_quota"
+		}
+		c.Header("Retry-After", strconv.Itoa(int(decision.Reset.Seconds())+1))
+		c.AbortWithStatusJSON(429, chat.NewError(decision.Err.Error(), errType, code))
+		return
+	}
+	defer func() {
+		ticket.Done(stats.FromContext(c).TotalTokens())
+	}()
+	c.Next()
+}
+
+// rateLimitSubject returns who the request is counted for and their limits,
+// keys without their own limits and static tokens get the default limits
+func rateLimitSubject(c *gin.Context) (string, settings.Limits) {
+	if key, ok := keystore.FromContext(c); ok {
+		if key.Limits != nil {
+			return key.ID, *key.Limits
+		}
+		return key.ID, settings.Get().DefaultLimits
+	}
+	token, ok := requestToken(c)
+	if !ok {
+		return "anonymous", settings.Get().DefaultLimits
+	}
+	sum := sha256.Sum256([]byte(token))
+	return "token:" + hex.EncodeToString(sum[:8]), settings.Get().DefaultLimits
+}
+
+// isStreamRequest peeks the stream flag of the json body, the body is left intact
+func isStreamRequest(c *gin.Context) bool {
+	// gemini streams by method instead of a flag
+	if strings.HasSuffix(c.Request.URL.Path, ":streamGenerateContent") {
+		return true
+	}
+	if c.Request.Body == nil {
+		return false
+	}
+	data, err := io.ReadAll(c.Request.Body)
+	c.Request.Body = io.NopCloser(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+	var body struct {
+		Stream *bool `json:"stream"`
+	}
+	json.Unmarshal(data, &body)
+	if body.Stream == nil {
+		// the ollama api streams unless told not to
+		return strings.HasPrefix(c.FullPath(), "/api/")
+	}
+	return *body.Stream
+}
+
+func setRateLimitHeaders(c *gin.Context, d ratelimit.Decision) {
+	reset := d.Reset.Round(time.Millisecond).String()
+	if d.Limits.RequestsPerMinute > 0 {
+		c.Header("x-ratelimit-limit-requests", strconv.Itoa(d.Limits.RequestsPerMinute))
+		c.Header("x-ratelimit-remaining-requests", strconv.Itoa(d.RemainingRequests))
+		c.Header("x-ratelimit-reset-requests", reset)
+	}
+	if d.Limits.TokensPerMinute > 0 {
+		c.Header("x-ratelimit-limit-tokens", strconv.Itoa(d.Limits.TokensPerMinute))
+		c.Header("x-ratelimit-remaining-tokens", strconv.Itoa(d.RemainingTokens))
+		c.Header("x-ratelimit-reset-tokens", reset)
+	}
+}
@@ -0,0 +1,171 @@
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"raychat/keystore"
+	"raychat/settings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const window = time.Minute
+
+var (
+	ErrRateLimited   = errors.New("rate limit exceeded")
+	ErrQuotaExceeded = errors.New("token quota exceeded")
+)
+
+func Logger() *logrus.Entry {
+	return logrus.WithField("prefix", "ratelimit")
+}
+
+// Limiter enforces the per minute limits in memory with fixed one minute
+// windows, daily and monthly token usage is kept in the key store. Tokens are
+// only known once a request is done, so the tokens per minute and the quotas
+// reject requests after the limit was reached, the request crossing it is let
+// through.
+type Limiter struct {
+	mu       sync.Mutex
+	store    *keystore.Store
+	subjects map[string]*subject
+	swept    time.Time
+}
+
+type subject struct {
+	windowStart time.Time
+	requests    int
+	tokens      int
+	streams     int
+}
+
+// Decision is the outcome of Acquire, Err is set when the request is rejected
+type Decision struct {
+	Limits            settings.Limits
+	RemainingRequests int
+	RemainingTokens   int
+	Reset             time.Duration
+	Err               error
+}
+
+// Ticket is held while an accepted request runs
+type Ticket struct {
+	l      *Limiter
+	id     string
+	stream bool
+}
+
+func New(store *keystore.Store) *Limiter {
+	return &Limiter{
+		store:    store,
+		subjects: map[string]*subject{},
+	}
+}
+
+// Acquire checks the limits of the subject id and counts the request when it is accepted,
+// the ticket is nil when the request is rejected
+func (l *Limiter) Acquire(id string, limits settings.Limits, stream bool) (*Ticket, Decision) {
+	now := time.Now()
+	d := Decision{Limits: limits}
+
+	if limits.DailyTokens > 0 || limits.MonthlyTokens > 0 {
+		daily, monthly, err := l.store.Usage(id, now)
+		if err != nil {
+			Logger().WithError(err).Error("read token usage failed, skip quota check")
+		}
+		switch {
+		case limits.DailyTokens > 0 && daily >= limits.DailyTokens:
+			d.Err = fmt.Errorf("%w: daily quota of %d tokens used up", ErrQuotaExceeded, limits.DailyTokens)
+		case limits.MonthlyTokens > 0 && monthly >= limits.MonthlyTokens:
+			d.Err = fmt.Errorf("%w: monthly quota of %d tokens used up", ErrQuotaExceeded, limits.MonthlyTokens)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	s := l.subject(id, now)
+	d.Reset = s.windowStart.Add(window).Sub(now)
+	d.RemainingRequests = max(limits.RequestsPerMinute-s.requests, 0)
+	d.RemainingTokens = max(limits.TokensPerMinute-s.tokens, 0)
+
+	switch {
+	case d.Err != nil:
+	case limits.RequestsPerMinute > 0 && s.requests >= limits.RequestsPerMinute:
+		d.Err = fmt.Errorf("%w: %d requests per minute", ErrRateLimited, limits.RequestsPerMinute)
+	case limits.TokensPerMinute > 0 && s.tokens >= limits.TokensPerMinute:
+		d.Err = fmt.Errorf("%w: %d tokens per minute", ErrRateLimited, limits.TokensPerMinute)
+	case stream && limits.ConcurrentStreams > 0 && s.streams >= limits.ConcurrentStreams:
+		d.Err = fmt.Errorf("%w: %d concurrent streams", ErrRateLimited, limits.ConcurrentStreams)
+	}
+	if d.Err != nil {
+		return nil, d
+	}
+
+	s.requests++
+	d.RemainingRequests = max(limits.RequestsPerMinute-s.requests, 0)
+	if stream {
+		s.streams++
+	}
+	return &Ticket{l: l, id: id, stream: stream}, d
+}
+
+func (l *Limiter) subject(id string, now time.Time) *subject {
+	s, ok := l.subjects[id]
+	if !ok {
+		s = &subject{windowStart: now}
+		l.subjects[id] = s
+	}
+	if now.Sub(s.windowStart) >= window {
+		s.windowStart, s.requests, s.tokens = now, 0, 0
+	}
+	return s
+}
+
+// sweep drops the subjects whose window is over and that hold no stream, it
+// runs at most once per window so the map only keeps the recent subjects
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < window {
+		return
+	}
+	l.swept = now
+	for id, s := range l.subjects {
+		if s.streams == 0 && now.Sub(s.windowStart) >= window {
+			delete(l.subjects, id)
+		}
+	}
+}
+
+// Done records the tokens the request used and releases its stream slot
+func (t *Ticket) Done(tokens int) {
+	now := time.Now()
+	t.l.mu.Lock()
+	s := t.l.subject(t.id, now)
+	s.tokens += tokens
+	if t.stream {
+		s.streams--
+	}
+	t.l.mu.Unlock()
+
+	if tokens == 0 {
+		return
+	}
+	if err := t.l.store.AddUsage(t.id, tokens, now); err != nil {
+		Logger().WithError(err).Error("record token usage failed")
+	}
+}
+
+var (
+	defaultLimiter *Limiter
+	once           sync.Once
+)
+
+// Default returns the limiter backed by the default key store
+func Default() *Limiter {
+	once.Do(func() {
+		defaultLimiter = New(keystore.Get())
+	})
+	return defaultLimiter
+}
@@ -0,0 +1,171 @@
+package ratelimit
+
+import (
+	"errors"
+	"path/filepath"
+	"raychat/keystore"
+	"raychat/settings"
+	"testing"
+	"time"
+)
+
+func newTestLimiter(t *testing.T) *Limiter {
+	t.Helper()
+	store, err := keystore.Open(filepath.Join(t.TempDir(), "keys.db"))
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return New(store)
+}
+
+// step is a request of the subject, done tokens are recorded right away
+// unless hold keeps the ticket open
+type step struct {
+	stream bool
+	tokens int
+	hold   bool
+}
+
+func TestAcquire(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits settings.Limits
+		before []step
+		stream bool
+		err    error
+		// remaining requests and tokens of the last decision
+		requests int
+		tokens   int
+	}{
+		{
+			name:   "unlimited",
+			before: []step{{}, {}, {}},
+		},
+		{
+			name:     "within requests per minute",
+			limits:   settings.Limits{RequestsPerMinute: 3},
+			before:   []step{{}},
+			requests: 1,
+		},
+		{
+			name:   "requests per minute used up",
+			limits: settings.Limits{RequestsPerMinute: 2},
+			before: []step{{}, {}},
+			err:    ErrRateLimited,
+		},
+		{
+			name:   "within tokens per minute",
+			limits: settings.Limits{TokensPerMinute: 100},
+			before: []step{{tokens: 40}},
+			tokens: 60,
+		},
+		{
+			name:   "tokens per minute used up",
+			limits: settings.Limits{TokensPerMinute: 100},
+			before: []step{{tokens: 60}, {tokens: 60}},
+			err:    ErrRateLimited,
+		},
+		{
+			name:   "concurrent streams used up",
+			limits: settings.Limits{ConcurrentStreams: 1},
+			before: []step{{stream: true, hold: true}},
+			stream: true,
+			err:    ErrRateLimited,
+		},
+		{
+			name:   "finished streams give their slot back",
+			limits: settings.Limits{ConcurrentStreams: 1},
+			before: []step{{stream: true}, {stream: true}},
+			stream: true,
+		},
+		{
+			name:   "streams do not limit plain requests",
+			limits: settings.Limits{ConcurrentStreams: 1},
+			before: []step{{stream: true, hold: true}},
+		},
+		{
+			name:   "daily quota used up",
+			limits: settings.Limits{DailyTokens: 50},
+			before: []step{{tokens: 50}},
+			err:    ErrQuotaExceeded,
+		},
+		{
+			name:   "within daily quota",
+			limits: settings.Limits{DailyTokens: 50},
+			before: []step{{tokens: 49}},
+		},
+		{
+			name:   "monthly quota used up",
+			limits: settings.Limits{MonthlyTokens: 10, DailyTokens: 100},
+			before: []step{{tokens: 20}},
+			err:    ErrQuotaExceeded,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLimiter(t)
+			for i, s := range tt.before {
+				ticket, d := l.Acquire("key_a", tt.limits, s.stream)
+				if d.Err != nil {
+					t.Fatalf("request %d rejected: %v", i, d.Err)
+				}
+				if !s.hold {
+					ticket.Done(s.tokens)
+				}
+			}
+
+			ticket, d := l.Acquire("key_a", tt.limits, tt.stream)
+			if !errors.Is(d.Err, tt.err) {
+				t.Fatalf("Acquire error = %v, want %v", d.Err, tt.err)
+			}
+			if (ticket == nil) != (tt.err != nil) {
+				t.Errorf("ticket = %v with error %v", ticket, d.Err)
+			}
+			if d.RemainingRequests != tt.requests || d.RemainingTokens != tt.tokens {
+				t.Errorf("remaining requests %d and tokens %d, want %d and %d", d.RemainingRequests, d.RemainingTokens, tt.requests, tt.tokens)
+			}
+			if d.Limits != tt.limits {
+				t.Errorf("limits = %+v, want %+v", d.Limits, tt.limits)
+			}
+			if d.Reset <= 0 || d.Reset > window {
+				t.Errorf("reset = %v, want within the window", d.Reset)
+			}
+
+			// other subjects have their own limits
+			if _, d := l.Acquire("key_b", tt.limits, tt.stream); d.Err != nil {
+				t.Errorf("other subject rejected: %v", d.Err)
+			}
+		})
+	}
+}
+
+func TestSweep(t *testing.T) {
+	l := newTestLimiter(t)
+	limits := settings.Limits{RequestsPerMinute: 10}
+	l.Acquire("idle", limits, false)
+	streaming, _ := l.Acquire("streaming", limits, true)
+	l.Acquire("recent", limits, false)
+
+	later := time.Now().Add(2 * window)
+	l.mu.Lock()
+	l.subjects["recent"].windowStart = later
+	l.sweep(later)
+	_, idle := l.subjects["idle"]
+	_, stream := l.subjects["streaming"]
+	_, recent := l.subjects["recent"]
+	l.mu.Unlock()
+	if idle || !stream || !recent {
+		t.Errorf("after the sweep idle %v, streaming %v, recent %v, want only idle dropped", idle, stream, recent)
+	}
+
+	streaming.Done(0)
+	l.mu.Lock()
+	l.swept = time.Time{}
+	l.sweep(time.Now().Add(4 * window))
+	n := len(l.subjects)
+	l.mu.Unlock()
+	if n != 0 {
+		t.Errorf("%d subjects left once every window is over", n)
+	}
+}
@@ -2,21 +2,60 @@ package service
 
 import (
 	"raychat/chat"
+	"raychat/keystore"
+	"raychat/metrics"
 	"raychat/middlewares"
+	"raychat/service/keys"
 	"raychat/service/models"
+	"raychat/settings"
 
 	"github.com/gin-gonic/gin"
 )
 
 func Run() {
-	r := gin.Default()
-	v1 := r.Group("/v1")
+	if err := keystore.Init(settings.Get().KeyDB); err != nil {
+		Logger().WithError(err).Fatalf("open key store %s error", settings.Get().KeyDB)
+	}
+	chat.Init(settings.Get())
+	r := gin.New()
+	r.Use(middlewares.RequestID, middlewares.AccessLog, gin.Recovery())
+	r.GET("/metrics", middlewares.Admin, metrics.Handler())
+	v1 := r.Group("/v1", metrics.Middleware, middlewares.Audit)
 	{
-		v1.GET("/models", models.GetModelsEndpoint)
-		v1.POST("/chat/completions", middlewares.Auth, chat.ChatEndpoint)
+		v1.GET("/models", middlewares.Auth, models.GetModelsEndpoint)
+		v1.GET("/models/*id", middlewares.Auth, models.GetModelEndpoint)
+		v1.POST("/chat/completions", middlewares.Auth, middlewares.RateLimit, chat.ChatEndpoint)
 		v1.OPTIONS("/chat/completions", OptionsHandler)
+		v1.POST("/completions", middlewares.Auth, middlewares.RateLimit, chat.CompletionsEndpoint)
+		v1.OPTIONS("/completions", OptionsHandler)
+		v1.POST("/messages", middlewares.Auth, middlewares.RateLimit, chat.MessagesEndpoint)
+		v1.OPTIONS("/messages", OptionsHandler)
+	}
+	ollama := r.Group("/api", metrics.Middleware, middlewares.Audit)
+	{
+		ollama.GET("/tags", middlewares.Auth, models.OllamaTagsEndpoint)
+		ollama.POST("/show", middlewares.Auth, models.OllamaShowEndpoint)
+		ollama.POST("/chat", middlewares.Auth, middlewares.RateLimit, chat.OllamaChatEndpoint)
+		ollama.POST("/generate", middlewares.Auth, middlewares.RateLimit, chat.OllamaGenerateEndpoint)
+	}
+	gemini := r.Group("/v1beta", metrics.Middleware, middlewares.Audit, middlewares.GeminiKey)
+	{
+		gemini.GET("/models", middlewares.Auth, models.GeminiModelsEndpoint)
+		gemini.GET("/models/*id", middlewares.Auth, models.GeminiModelEndpoint)
+		// the model and the method share the last segment, models/{model}:generateContent
+		gemini.POST("/models/*action", middlewares.Auth, middlewares.RateLimit, chat.GeminiEndpoint)
+	}
+	admin := r.Group("/admin", middlewares.Admin)
+	{
+		admin.GET("/keys", keys.ListKeysEndpoint)
+		admin.POST("/keys", keys.CreateKeyEndpoint)
+		admin.GET("/keys/:id", keys.GetKeyEndpoint)
+		admin.PATCH("/keys/:id", keys.UpdateKeyEndpoint)
+		admin.POST("/keys/:id/rotate", keys.RotateKeyEndpoint)
+		admin.DELETE("/keys/:id", keys.RevokeKeyEndpoint)
 	}
-	r.Run(":8080")
+	settings.Watch()
+	serve(r, settings.Get())
 }
 
 func OptionsHandler(c *gin.Context) {
@@ -0,0 +1,132 @@
+package keys
+
+import (
+	"errors"
+	"net/http"
+	"raychat/chat"
+	"raychat/keystore"
+	"raychat/settings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type KeyRequest struct {
+	Name      *string          `json:"name"`
+	ExpiresAt *time.Time       `json:"expires_at"`
+	Models    *[]string        `json:"models"`
+	Limits    *settings.Limits `json:"limits"`
+	Disabled  *bool            `json:"disabled"`
+}
+
+func (r KeyRequest) apply(k *keystore.Key) {
+	if r.Name != nil {
+		k.Name = *r.Name
+	}
+	if r.ExpiresAt != nil {
+		k.ExpiresAt = r.ExpiresAt
+		if r.ExpiresAt.IsZero() {
+			k.ExpiresAt = nil
+		}
+	}
+	if r.Models != nil {
+		k.Models = *r.Models
+	}
+	if r.Limits != nil {
+		k.Limits = r.Limits
+	}
+	if r.Disabled != nil {
+		k.Disabled = *r.Disabled
+	}
+}
+
+// KeyWithSecret is returned once when a key is created or rotated
+type KeyWithSecret struct {
+	keystore.Key
+	Secret string `json:"key"`
+}
+
+func CreateKeyEndpoint(c *gin.Context) {
+	req := KeyRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+	k := keystore.Key{}
+	req.apply(&k)
+	k, secret, err := keystore.Get().Create(k)
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusCreated, KeyWithSecret{Key: k, Secret: secret})
+}
+
+func ListKeysEndpoint(c *gin.Context) {
+	keys, err := keystore.Get().List()
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": keys})
+}
+
+func GetKeyEndpoint(c *gin.Context) {
+	k, err := keystore.Get().Get(c.Param("id"))
+	if err != nil {
+		abortWithStoreError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, k)
+}
+
+func UpdateKeyEndpoint(c *gin.Context) {
+	req := KeyRequest{}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		abortWithError(c, http.StatusBadRequest, err)
+		return
+	}
+	k, err := keystore.Get().Update(c.Param("id"), req.apply)
+	if err != nil {
+		abortWithStoreError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, k)
+}
+
+func RotateKeyEndpoint(c *gin.Context) {
+	k, secret, err := keystore.Get().Rotate(c.Param("id"))
+	if err != nil {
+		abortWithStoreError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, KeyWithSecret{Key: k, Secret: secret})
+}
+
+func RevokeKeyEndpoint(c *gin.Context) {
+	id := c.Param("id")
+	if err := keystore.Get().Delete(id); err != nil {
+		abortWithStoreError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": id, "deleted": true})
+}
+
+func abortWithStoreError(c *gin.Context, err error) {
+	if errors.Is(err, keystore.ErrNotFound) {
+		abortWithError(c, http.StatusNotFound, err)
+		return
+	}
+	abortWithError(c, http.StatusInternalServerError, err)
+}
+
+func abortWithError(c *gin.Context, status int, err error) {
+	errType, code := "invalid_request_error", "invalid_request"
+	switch {
+	case status == http.StatusNotFound:
+		code = "not_found"
+	case status >= 500:
+		errType, code = "server_error", "internal_error"
+	}
+	c.AbortWithStatusJSON(status, chat.NewError(err.Error(), errType, code))
+}
@@ -0,0 +1,58 @@
+package models
+
+import (
+	"net/http"
+	"raychat/chat"
+	"raychat/keystore"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type GeminiModel struct {
+	Name                       string   `json:"name"`
+	BaseModelID                string   `json:"baseModelId"`
+	Version                    string   `json:"version"`
+	DisplayName                string   `json:"displayName"`
+	Description                string   `json:"description,omitempty"`
+	InputTokenLimit            int      `json:"inputTokenLimit"`
+	SupportedGenerationMethods []string `json:"supportedGenerationMethods"`
+}
+
+func FromModelInfoGemini(info chat.ModelInfo) GeminiModel {
+	return GeminiModel{
+		Name:                       "models/" + info.Model,
+		BaseModelID:                info.Model,
+		Version:                    "raycast",
+		DisplayName:                info.Name,
+		Description:                info.Description,
+		InputTokenLimit:            info.Context,
+		SupportedGenerationMethods: []string{"generateContent", "streamGenerateContent"},
+	}
+}
+
+func GeminiModelsEndpoint(c *gin.Context) {
+	infos, _ := chat.GetModelInfos()
+	key, hasKey := keystore.FromContext(c)
+	models := make([]GeminiModel, 0, len(infos))
+	for _, info := range infos {
+		if hasKey && !key.AllowsModel(info.Model) {
+			continue
+		}
+		models = append(models, FromModelInfoGemini(info))
+	}
+	c.JSON(http.StatusOK, gin.H{"models": models})
+}
+
+func GeminiModelEndpoint(c *gin.Context) {
+	id := strings.TrimPrefix(c.Param("id"), "/")
+	if info, _, ok := findModel(c, id); ok {
+		c.JSON(http.StatusOK, FromModelInfoGemini(info))
+		return
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": gin.H{
+		"code":    http.StatusNotFound,
+		"message": "models/" + id + " is not found",
+		"status":  "NOT_FOUND",
+	}})
+}
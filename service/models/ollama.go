@@ -0,0 +1,124 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"raychat/chat"
+	"raychat/keystore"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type OllamaModelDetails struct {
+	ParentModel       string   `json:"parent_model"`
+	Format            string   `json:"format"`
+	Family            string   `json:"family"`
+	Families          []string `json:"families"`
+	ParameterSize     string   `json:"parameter_size"`
+	QuantizationLevel string   `json:"quantization_level"`
+}
+
+type OllamaModel struct {
+	Name       string             `json:"name"`
+	Model      string             `json:"model"`
+	ModifiedAt time.Time          `json:"modified_at"`
+	Size       int64              `json:"size"`
+	Digest     string             `json:"digest"`
+	Details    OllamaModelDetails `json:"details"`
+}
+
+type OllamaShowResponse struct {
+	Modelfile    string             `json:"modelfile"`
+	Parameters   string             `json:"parameters"`
+	Template     string             `json:"template"`
+	Details      OllamaModelDetails `json:"details"`
+	ModelInfo    map[string]any     `json:"model_info"`
+	Capabilities []string           `json:"capabilities"`
+	ModifiedAt   time.Time          `json:"modified_at"`
+}
+
+func ollamaDetails(info chat.ModelInfo) OllamaModelDetails {
+	return OllamaModelDetails{
+		Format:   "raycast",
+		Family:   info.Provider,
+		Families: []string{info.Provider},
+	}
+}
+
+func FromModelInfoOllama(info chat.ModelInfo, modifiedAt time.Time) OllamaModel {
+	// there are no weights, the digest only has to be stable
+	digest := sha256.Sum256([]byte(info.Model))
+	return OllamaModel{
+		Name:       info.Model,
+		Model:      info.Model,
+		ModifiedAt: modifiedAt,
+		Digest:     hex.EncodeToString(digest[:]),
+		Details:    ollamaDetails(info),
+	}
+}
+
+// findModel returns the catalog entry of model the api key may use
+func findModel(c *gin.Context, model string) (chat.ModelInfo, time.Time, bool) {
+	infos, fetchedAt := chat.GetModelInfos()
+	key, hasKey := keystore.FromContext(c)
+	for _, info := range infos {
+		if hasKey && !key.AllowsModel(info.Model) {
+			continue
+		}
+		if info.Model == model {
+			return info, fetchedAt, true
+		}
+	}
+	return chat.ModelInfo{}, fetchedAt, false
+}
+
+func OllamaTagsEndpoint(c *gin.Context) {
+	infos, fetchedAt := chat.GetModelInfos()
+	key, hasKey := keystore.FromContext(c)
+	models := make([]OllamaModel, 0, len(infos))
+	for _, info := range infos {
+		if hasKey && !key.AllowsModel(info.Model) {
+			continue
+		}
+		models = append(models, FromModelInfoOllama(info, fetchedAt))
+	}
+	c.JSON(http.StatusOK, gin.H{"models": models})
+}
+
+func OllamaShowEndpoint(c *gin.Context) {
+	var req struct {
+		Model string `json:"model"`
+		// Name is the field of older ollama clients
+		Name string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Model == "" {
+		req.Model = req.Name
+	}
+	info, fetchedAt, ok := findModel(c, strings.TrimSuffix(req.Model, ":latest"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("model '%s' not found", req.Model)})
+		return
+	}
+	capabilities := []string{"completion"}
+	if info.SupportsVision() {
+		capabilities = append(capabilities, "vision")
+	}
+	c.JSON(http.StatusOK, OllamaShowResponse{
+		Details: ollamaDetails(info),
+		ModelInfo: map[string]any{
+			"general.architecture":            info.Provider,
+			"general.basename":                info.Name,
+			info.Provider + ".context_length": info.Context,
+		},
+		Capabilities: capabilities,
+		ModifiedAt:   fetchedAt,
+	})
+}
@@ -0,0 +1,92 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"raychat/keystore"
+	"raychat/settings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+func Logger() *logrus.Entry {
+	return logrus.WithField("prefix", "service")
+}
+
+// serve listens on the configured address and unix socket until SIGTERM or
+// SIGINT, then stops accepting connections and lets open streams finish until
+// the shutdown timeout is over
+func serve(handler http.Handler, conf settings.RayConfig) {
+	listeners := []net.Listener{}
+	if conf.Listen != "" {
+		l, err := net.Listen("tcp", conf.Listen)
+		if err != nil {
+			Logger().WithError(err).Fatalf("listen on %s error", conf.Listen)
+		}
+		listeners = append(listeners, l)
+	}
+	if conf.UnixSocket != "" {
+		l, err := listenUnix(conf.UnixSocket)
+		if err != nil {
+			Logger().WithError(err).Fatalf("listen on %s error", conf.UnixSocket)
+		}
+		listeners = append(listeners, l)
+	}
+
+	srv := &http.Server{Handler: handler}
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			Logger().Infof("listening on %s", l.Addr())
+			var err error
+			if conf.TLSCert != "" {
+				err = srv.ServeTLS(l, conf.TLSCert, conf.TLSKey)
+			} else {
+				err = srv.Serve(l)
+			}
+			errs <- err
+		}(l)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	select {
+	case <-ctx.Done():
+		Logger().Info("shutting down, waiting for open requests")
+	case err := <-errs:
+		Logger().WithError(err).Error("server error, shutting down")
+	}
+	stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		Logger().WithError(err).Warn("shutdown timeout, closing open requests")
+		srv.Close()
+	}
+	if err := keystore.Get().Close(); err != nil {
+		Logger().WithError(err).Error("close key store error")
+	}
+	Logger().Info("server stopped")
+}
+
+// listenUnix listens on the socket at path, a stale socket file left by a
+// previous run is removed first
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			os.Remove(path)
+		} else {
+			conn.Close()
+		}
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
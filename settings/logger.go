@@ -0,0 +1,22 @@
+package settings
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// setupLogger applies LOG_FORMAT and LOG_LEVEL, it runs before any other
+// package logs so every entry has the same format
+func setupLogger(conf RayConfig) {
+	switch conf.LogFormat {
+	case "text":
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	default:
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	}
+	level, err := logrus.ParseLevel(conf.LogLevel)
+	if err != nil {
+		logrus.WithError(err).Warn("invalid LOG_LEVEL, use info")
+		level = logrus.InfoLevel
+	}
+	logrus.SetLevel(level)
+}
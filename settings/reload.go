@@ -0,0 +1,136 @@
+package settings
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+const configFileEnv = "CONFIG_FILE"
+
+// reloadDelay waits for editors to finish writing the config file
+const reloadDelay = 500 * time.Millisecond
+
+var (
+	reloadMu  sync.Mutex
+	listeners []func(old, conf RayConfig)
+)
+
+func Logger() *logrus.Entry {
+	return logrus.WithField("prefix", "settings")
+}
+
+// OnChange registers fn to be called with the old and the new config after a reload
+func OnChange(fn func(old, conf RayConfig)) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	listeners = append(listeners, fn)
+}
+
+// Reload reads the config again and applies it, an invalid config is rejected
+// and the current one is kept
+func Reload() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	conf, err := load()
+	if err != nil {
+		Logger().WithError(err).Error("reload config rejected, keep the current config")
+		return err
+	}
+	old := Get()
+	for _, name := range restartRequired(old, conf) {
+		Logger().Warnf("%s changed, it is applied on restart", name)
+	}
+	setupLogger(conf)
+	rayConf.Store(&conf)
+	for _, fn := range listeners {
+		fn(old, conf)
+	}
+	Logger().Info("config reloaded")
+	return nil
+}
+
+// restartRequired returns the options that changed but are only read on start
+func restartRequired(old, conf RayConfig) []string {
+	changed := []string{}
+	for _, option := range []struct {
+		name    string
+		differs bool
+	}{
+		{"LISTEN", old.Listen != conf.Listen},
+		{"UNIX_SOCKET", old.UnixSocket != conf.UnixSocket},
+		{"TLS_CERT", old.TLSCert != conf.TLSCert || old.TLSKey != conf.TLSKey},
+		{"KEY_DB", old.KeyDB != conf.KeyDB},
+		{"AUDIT_LOG", old.AuditLog != conf.AuditLog || old.AuditMaxSize != conf.AuditMaxSize || old.AuditMaxFiles != conf.AuditMaxFiles},
+		{"UPSTREAM_CONNECT_TIMEOUT", old.UpstreamConnectTimeout != conf.UpstreamConnectTimeout},
+		{"UPSTREAM_MAX_IDLE_CONNS", old.UpstreamMaxIdleConns != conf.UpstreamMaxIdleConns},
+	} {
+		if option.differs {
+			changed = append(changed, option.name)
+		}
+	}
+	return changed
+}
+
+// Watch reloads the config on SIGHUP and whenever CONFIG_FILE changes
+func Watch() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			Logger().Info("SIGHUP received, reloading config")
+			Reload()
+		}
+	}()
+
+	file := os.Getenv(configFileEnv)
+	if file == "" {
+		return
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		Logger().WithError(err).Error("watch config file error, reload with SIGHUP")
+		return
+	}
+	// watch the directory, editors and config maps replace the file instead of writing it
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		Logger().WithError(err).Error("watch config file error, reload with SIGHUP")
+		watcher.Close()
+		return
+	}
+	go func() {
+		var timer *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				// kubernetes config maps swap the ..data symlink instead of touching the file
+				name := filepath.Clean(event.Name)
+				if name != filepath.Clean(file) && !strings.HasPrefix(filepath.Base(name), "..data") || event.Op == fsnotify.Chmod {
+					continue
+				}
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(reloadDelay, func() {
+					Logger().Info("config file changed, reloading config")
+					Reload()
+				})
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				Logger().WithError(err).Warn("watch config file error")
+			}
+		}
+	}()
+}
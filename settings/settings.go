@@ -1,35 +1,343 @@
 package settings
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
 	"github.com/ilyakaznacheev/cleanenv"
 	"github.com/joho/godotenv"
+	"github.com/samber/lo"
 	"github.com/sirupsen/logrus"
 )
 
 type RayConfig struct {
-	ClientID      string   `env:"CLIENT_ID"`
-	ClientSecret  string   `env:"CLIENT_SECRET"`
-	Email         string   `env:"EMAIL"`
-	Password      string   `env:"PASSWORD"`
-	Token         string   `env:"TOKEN" env-default:""`
-	ExternalToken []string `env:"EXTERNAL_TOKEN" env-default:""`
+	ClientID          string         `env:"CLIENT_ID" yaml:"client_id" toml:"client_id"`
+	ClientSecret      string         `env:"CLIENT_SECRET" yaml:"client_secret" toml:"client_secret"`
+	Email             string         `env:"EMAIL" yaml:"email" toml:"email"`
+	Password          string         `env:"PASSWORD" yaml:"password" toml:"password"`
+	Token             string         `env:"TOKEN" env-default:"" yaml:"token" toml:"token"`
+	TokenTTL          time.Duration  `env:"TOKEN_TTL" env-default:"24h" yaml:"token_ttl" toml:"token_ttl"`
+	ExternalToken     []string       `env:"EXTERNAL_TOKEN" env-default:"" yaml:"external_token" toml:"external_token"`
+	Accounts          Accounts       `env:"ACCOUNTS" yaml:"accounts" toml:"accounts"`
+	ModelAliases      ModelAliases   `env:"MODEL_ALIASES" yaml:"model_aliases" toml:"model_aliases"`
+	ModelFallbacks    ModelFallbacks `env:"MODEL_FALLBACKS" yaml:"model_fallbacks" toml:"model_fallbacks"`
+	StrictModels      bool           `env:"STRICT_MODELS" yaml:"strict_models" toml:"strict_models"`
+	ImageFetch        bool           `env:"IMAGE_FETCH" yaml:"image_fetch" toml:"image_fetch"`
+	DefaultModel      string         `env:"DEFAULT_MODEL" env-default:"gpt-3.5-turbo" yaml:"default_model" toml:"default_model"`
+	StructuredRetries int            `env:"STRUCTURED_OUTPUT_RETRIES" env-default:"2" yaml:"structured_output_retries" toml:"structured_output_retries"`
+	MaxChoices        int            `env:"MAX_CHOICES" env-default:"8" yaml:"max_choices" toml:"max_choices"`
+	FanoutPerAccount  int            `env:"FANOUT_PER_ACCOUNT" env-default:"2" yaml:"fanout_per_account" toml:"fanout_per_account"`
+	BalanceStrategy   string         `env:"BALANCE_STRATEGY" env-default:"round_robin" yaml:"balance_strategy" toml:"balance_strategy"`
+	AccountCooldown   time.Duration  `env:"ACCOUNT_COOLDOWN" env-default:"1m" yaml:"account_cooldown" toml:"account_cooldown"`
+	KeyDB             string         `env:"KEY_DB" env-default:"raychat.db" yaml:"key_db" toml:"key_db"`
+	AdminToken        string         `env:"ADMIN_TOKEN" yaml:"admin_token" toml:"admin_token"`
+	DefaultLimits     Limits         `yaml:"limits" toml:"limits"`
+	Listen            string         `env:"LISTEN" env-default:":8080" yaml:"listen" toml:"listen"`
+	UnixSocket        string         `env:"UNIX_SOCKET" yaml:"unix_socket" toml:"unix_socket"`
+	TLSCert           string         `env:"TLS_CERT" yaml:"tls_cert" toml:"tls_cert"`
+	TLSKey            string         `env:"TLS_KEY" yaml:"tls_key" toml:"tls_key"`
+	ShutdownTimeout   time.Duration  `env:"SHUTDOWN_TIMEOUT" env-default:"30s" yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+
+	UpstreamConnectTimeout time.Duration `env:"UPSTREAM_CONNECT_TIMEOUT" env-default:"10s" yaml:"upstream_connect_timeout" toml:"upstream_connect_timeout"`
+	UpstreamIdleTimeout    time.Duration `env:"UPSTREAM_IDLE_TIMEOUT" env-default:"60s" yaml:"upstream_idle_timeout" toml:"upstream_idle_timeout"`
+	UpstreamProxy          string        `env:"UPSTREAM_PROXY" yaml:"upstream_proxy" toml:"upstream_proxy"`
+	UpstreamMaxIdleConns   int           `env:"UPSTREAM_MAX_IDLE_CONNS" env-default:"32" yaml:"upstream_max_idle_conns" toml:"upstream_max_idle_conns"`
+	UpstreamRetries        int           `env:"UPSTREAM_RETRIES" env-default:"2" yaml:"upstream_retries" toml:"upstream_retries"`
+	UpstreamRetryBackoff   time.Duration `env:"UPSTREAM_RETRY_BACKOFF" env-default:"500ms" yaml:"upstream_retry_backoff" toml:"upstream_retry_backoff"`
+	UpstreamRetryMaxWait   time.Duration `env:"UPSTREAM_RETRY_MAX_WAIT" env-default:"10s" yaml:"upstream_retry_max_wait" toml:"upstream_retry_max_wait"`
+	BreakerThreshold       int           `env:"BREAKER_THRESHOLD" env-default:"5" yaml:"breaker_threshold" toml:"breaker_threshold"`
+	BreakerCooldown        time.Duration `env:"BREAKER_COOLDOWN" env-default:"30s" yaml:"breaker_cooldown" toml:"breaker_cooldown"`
+
+	LogFormat     string `env:"LOG_FORMAT" env-default:"json" yaml:"log_format" toml:"log_format"`
+	LogLevel      string `env:"LOG_LEVEL" env-default:"info" yaml:"log_level" toml:"log_level"`
+	AuditLog      string `env:"AUDIT_LOG" yaml:"audit_log" toml:"audit_log"`
+	AuditMaxSize  int    `env:"AUDIT_MAX_SIZE" env-default:"100" yaml:"audit_max_size" toml:"audit_max_size"`
+	AuditMaxFiles int    `env:"AUDIT_MAX_FILES" env-default:"10" yaml:"audit_max_files" toml:"audit_max_files"`
+}
+
+// Limits are the rate limits and token quotas of an api key, 0 means unlimited.
+// The env values apply to keys without their own limits and to EXTERNAL_TOKEN.
+type Limits struct {
+	RequestsPerMinute int `env:"LIMIT_RPM" json:"requests_per_minute,omitempty" yaml:"requests_per_minute" toml:"requests_per_minute"`
+	TokensPerMinute   int `env:"LIMIT_TPM" json:"tokens_per_minute,omitempty" yaml:"tokens_per_minute" toml:"tokens_per_minute"`
+	ConcurrentStreams int `env:"LIMIT_CONCURRENT_STREAMS" json:"concurrent_streams,omitempty" yaml:"concurrent_streams" toml:"concurrent_streams"`
+	DailyTokens       int `env:"LIMIT_DAILY_TOKENS" json:"daily_tokens,omitempty" yaml:"daily_tokens" toml:"daily_tokens"`
+	MonthlyTokens     int `env:"LIMIT_MONTHLY_TOKENS" json:"monthly_tokens,omitempty" yaml:"monthly_tokens" toml:"monthly_tokens"`
+}
+
+const (
+	BalanceRoundRobin    = "round_robin"
+	BalanceLeastInflight = "least_inflight"
+)
+
+// AccountConfig is a single raycast account, it logs in with Email and Password
+// unless Token is set. ClientID, ClientSecret and Proxy default to the global ones.
+type AccountConfig struct {
+	Name         string `json:"name" yaml:"name" toml:"name"`
+	ClientID     string `json:"client_id" yaml:"client_id" toml:"client_id"`
+	ClientSecret string `json:"client_secret" yaml:"client_secret" toml:"client_secret"`
+	Email        string `json:"email" yaml:"email" toml:"email"`
+	Password     string `json:"password" yaml:"password" toml:"password"`
+	Token        string `json:"token" yaml:"token" toml:"token"`
+	Proxy        string `json:"proxy" yaml:"proxy" toml:"proxy"`
+}
+
+// Accounts is read from the ACCOUNTS env as a json array
+type Accounts []AccountConfig
+
+func (a *Accounts) SetValue(s string) error {
+	if len(s) == 0 {
+		return nil
+	}
+	return json.Unmarshal([]byte(s), a)
+}
+
+// ModelAlias routes requests for models matching Match, a model name or a glob
+// pattern, to the raycast Model. Provider defaults to the one raycast reports.
+type ModelAlias struct {
+	Match    string `json:"match" yaml:"match" toml:"match"`
+	Model    string `json:"model" yaml:"model" toml:"model"`
+	Provider string `json:"provider" yaml:"provider" toml:"provider"`
 }
 
-var rayConf RayConfig
+// ModelAliases is read from the MODEL_ALIASES env as a json array, the first
+// matching alias wins
+type ModelAliases []ModelAlias
+
+func (a *ModelAliases) SetValue(s string) error {
+	if len(s) == 0 {
+		return nil
+	}
+	return json.Unmarshal([]byte(s), a)
+}
+
+// ModelFallbacks maps a model to the models tried in order when raycast can not
+// serve it, it is read from the MODEL_FALLBACKS env as a json object
+type ModelFallbacks map[string][]string
+
+func (f *ModelFallbacks) SetValue(s string) error {
+	if len(s) == 0 {
+		return nil
+	}
+	return json.Unmarshal([]byte(s), f)
+}
+
+var rayConf atomic.Pointer[RayConfig]
 
 func init() {
 	if err := godotenv.Load(); err != nil {
 		logrus.WithError(err).Warn("load .env file error, try to read from env")
 	}
-	err := cleanenv.ReadEnv(&rayConf)
+	conf, err := load()
 	if err != nil {
-		logrus.Panic("read env error", err)
+		logrus.WithError(err).Panic("read config error")
 	}
-	if len(rayConf.ExternalToken) == 0 {
-		logrus.Warn("ExternalToken is empty, skip auth, recommend to set it")
+	setupLogger(conf)
+	rayConf.Store(&conf)
+	if len(conf.ExternalToken) == 0 && len(conf.AdminToken) == 0 {
+		logrus.Warn("ExternalToken and AdminToken are empty, auth is skipped, recommend to set one of them")
 	}
 }
 
+// load reads CONFIG_FILE if set, env vars override the values from the file
+func load() (RayConfig, error) {
+	var conf RayConfig
+	if err := cleanenv.ReadEnv(&conf); err != nil {
+		return conf, err
+	}
+	if file := os.Getenv(configFileEnv); file != "" {
+		// the defaults are in place before the file is read, so a 0 in the
+		// file is kept instead of being taken for a missing value
+		env := conf
+		if err := readFile(file, &conf); err != nil {
+			return conf, err
+		}
+		overrideEnv(reflect.ValueOf(&conf).Elem(), reflect.ValueOf(env))
+	}
+	return conf, conf.Validate()
+}
+
+// readFile decodes the yaml, json or toml file over conf, keys missing in the
+// file keep their value
+func readFile(file string, conf *RayConfig) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	switch ext := strings.ToLower(path.Ext(file)); ext {
+	case ".yaml", ".yml":
+		err = cleanenv.ParseYAML(f, conf)
+	case ".json":
+		err = cleanenv.ParseJSON(f, conf)
+	case ".toml":
+		err = cleanenv.ParseTOML(f, conf)
+	default:
+		return fmt.Errorf("config file %s: unsupported format %q", file, ext)
+	}
+	if err != nil {
+		return fmt.Errorf("config file %s: %w", file, err)
+	}
+	return nil
+}
+
+// overrideEnv copies the fields of env whose env vars are set into conf
+func overrideEnv(conf, env reflect.Value) {
+	for i := 0; i < conf.NumField(); i++ {
+		field := conf.Type().Field(i)
+		names, ok := field.Tag.Lookup("env")
+		if !ok {
+			if field.Type.Kind() == reflect.Struct {
+				overrideEnv(conf.Field(i), env.Field(i))
+			}
+			continue
+		}
+		for _, name := range strings.Split(names, ",") {
+			if _, set := os.LookupEnv(name); set {
+				conf.Field(i).Set(env.Field(i))
+				break
+			}
+		}
+	}
+}
+
+// Get returns the current config, it may change on reload so read it once per use
 func Get() RayConfig {
-	return rayConf
+	return *rayConf.Load()
+}
+
+// Validate checks the config is usable, a config failing it is never applied
+func (c RayConfig) Validate() error {
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("TLS_CERT and TLS_KEY must be set together")
+	}
+	if c.Listen == "" && c.UnixSocket == "" {
+		return errors.New("LISTEN or UNIX_SOCKET must be set")
+	}
+	if c.BalanceStrategy != BalanceRoundRobin && c.BalanceStrategy != BalanceLeastInflight {
+		return fmt.Errorf("unknown BALANCE_STRATEGY %q", c.BalanceStrategy)
+	}
+	if c.LogFormat != "json" && c.LogFormat != "text" {
+		return fmt.Errorf("unknown LOG_FORMAT %q", c.LogFormat)
+	}
+	if _, err := logrus.ParseLevel(c.LogLevel); err != nil {
+		return fmt.Errorf("invalid LOG_LEVEL: %w", err)
+	}
+	for name, d := range map[string]time.Duration{
+		"TOKEN_TTL":                c.TokenTTL,
+		"ACCOUNT_COOLDOWN":         c.AccountCooldown,
+		"SHUTDOWN_TIMEOUT":         c.ShutdownTimeout,
+		"UPSTREAM_CONNECT_TIMEOUT": c.UpstreamConnectTimeout,
+		"UPSTREAM_IDLE_TIMEOUT":    c.UpstreamIdleTimeout,
+		"UPSTREAM_RETRY_BACKOFF":   c.UpstreamRetryBackoff,
+		"UPSTREAM_RETRY_MAX_WAIT":  c.UpstreamRetryMaxWait,
+		"BREAKER_COOLDOWN":         c.BreakerCooldown,
+	} {
+		if d < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+	for name, n := range map[string]int{
+		"UPSTREAM_MAX_IDLE_CONNS":   c.UpstreamMaxIdleConns,
+		"UPSTREAM_RETRIES":          c.UpstreamRetries,
+		"STRUCTURED_OUTPUT_RETRIES": c.StructuredRetries,
+		"FANOUT_PER_ACCOUNT":        c.FanoutPerAccount,
+		"BREAKER_THRESHOLD":         c.BreakerThreshold,
+		"LIMIT_RPM":                 c.DefaultLimits.RequestsPerMinute,
+		"LIMIT_TPM":                 c.DefaultLimits.TokensPerMinute,
+		"LIMIT_CONCURRENT_STREAMS":  c.DefaultLimits.ConcurrentStreams,
+		"LIMIT_DAILY_TOKENS":        c.DefaultLimits.DailyTokens,
+		"LIMIT_MONTHLY_TOKENS":      c.DefaultLimits.MonthlyTokens,
+	} {
+		if n < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+	for _, alias := range c.ModelAliases {
+		if _, err := path.Match(alias.Match, ""); err != nil || alias.Match == "" {
+			return fmt.Errorf("invalid model alias pattern %q", alias.Match)
+		}
+		if alias.Model == "" {
+			return fmt.Errorf("model alias %q has no model", alias.Match)
+		}
+	}
+	for model, chain := range c.ModelFallbacks {
+		if lo.Contains(chain, "") {
+			return fmt.Errorf("model fallbacks of %q contain an empty model", model)
+		}
+	}
+	if c.MaxChoices < 1 {
+		return errors.New("MAX_CHOICES must be at least 1")
+	}
+	if !c.StrictModels && c.DefaultModel == "" {
+		return errors.New("DEFAULT_MODEL must be set unless STRICT_MODELS is enabled")
+	}
+	names := map[string]bool{}
+	for _, account := range c.GetAccounts() {
+		if names[account.Name] {
+			return fmt.Errorf("duplicate account name %q", account.Name)
+		}
+		names[account.Name] = true
+		if account.Token == "" && (account.Email == "" || account.Password == "") {
+			return fmt.Errorf("account %s needs a token or email and password", account.Name)
+		}
+		if err := validateProxy(account.Proxy); err != nil {
+			return fmt.Errorf("account %s: %w", account.Name, err)
+		}
+	}
+	return validateProxy(c.UpstreamProxy)
+}
+
+func validateProxy(proxy string) error {
+	if proxy == "" {
+		return nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return fmt.Errorf("invalid proxy %q: %w", proxy, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return nil
+	}
+	return fmt.Errorf("invalid proxy %q: unsupported scheme %q", proxy, u.Scheme)
+}
+
+// GetAccounts returns all configured accounts, the single account configured by
+// EMAIL/PASSWORD or TOKEN is named "default" and comes first.
+func (c RayConfig) GetAccounts() []AccountConfig {
+	accounts := []AccountConfig{}
+	if c.Token != "" || c.Email != "" {
+		accounts = append(accounts, AccountConfig{
+			Name:     "default",
+			Email:    c.Email,
+			Password: c.Password,
+			Token:    c.Token,
+		})
+	}
+	accounts = append(accounts, c.Accounts...)
+	for i := range accounts {
+		if accounts[i].Name == "" {
+			accounts[i].Name = "account-" + strconv.Itoa(i)
+		}
+		if accounts[i].ClientID == "" {
+			accounts[i].ClientID = c.ClientID
+		}
+		if accounts[i].ClientSecret == "" {
+			accounts[i].ClientSecret = c.ClientSecret
+		}
+		if accounts[i].Proxy == "" {
+			accounts[i].Proxy = c.UpstreamProxy
+		}
+	}
+	return accounts
 }
@@ -0,0 +1,106 @@
+package settings
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadFile(t *testing.T) {
+	tests := []struct {
+		name  string
+		file  string
+		data  string
+		env   map[string]string
+		check func(RayConfig) bool
+	}{
+		{
+			name: "zeros in yaml are kept",
+			file: "config.yaml",
+			data: "breaker_threshold: 0\nupstream_retries: 0\nfanout_per_account: 0\ntoken_ttl: 0s\nupstream_idle_timeout: 0s\n",
+			check: func(c RayConfig) bool {
+				return c.BreakerThreshold == 0 && c.UpstreamRetries == 0 && c.FanoutPerAccount == 0 &&
+					c.TokenTTL == 0 && c.UpstreamIdleTimeout == 0
+			},
+		},
+		{
+			name: "zeros in toml are kept",
+			file: "config.toml",
+			data: "breaker_threshold = 0\nupstream_retries = 0\n",
+			check: func(c RayConfig) bool {
+				return c.BreakerThreshold == 0 && c.UpstreamRetries == 0
+			},
+		},
+		{
+			name: "missing keys get the defaults",
+			file: "config.yaml",
+			data: "max_choices: 4\n",
+			check: func(c RayConfig) bool {
+				return c.MaxChoices == 4 && c.BreakerThreshold == 5 && c.UpstreamRetries == 2 &&
+					c.TokenTTL == 24*time.Hour && c.Listen == ":8080"
+			},
+		},
+		{
+			name: "env overrides the file",
+			file: "config.yaml",
+			data: "breaker_threshold: 0\nupstream_retries: 3\n",
+			env:  map[string]string{"BREAKER_THRESHOLD": "7"},
+			check: func(c RayConfig) bool {
+				return c.BreakerThreshold == 7 && c.UpstreamRetries == 3
+			},
+		},
+		{
+			name: "nested limits",
+			file: "config.yaml",
+			data: "limits:\n  requests_per_minute: 60\n  daily_tokens: 100\n",
+			env:  map[string]string{"LIMIT_DAILY_TOKENS": "200"},
+			check: func(c RayConfig) bool {
+				return c.DefaultLimits.RequestsPerMinute == 60 && c.DefaultLimits.DailyTokens == 200
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(file, []byte(tt.data), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv(configFileEnv, file)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			conf, err := load()
+			if err != nil {
+				t.Fatalf("load: %v", err)
+			}
+			if !tt.check(conf) {
+				t.Errorf("unexpected config %+v", conf)
+			}
+		})
+	}
+}
+
+func TestLoadFileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		data string
+	}{
+		{name: "unsupported format", file: "config.ini", data: "a = 1"},
+		{name: "broken yaml", file: "config.yaml", data: "breaker_threshold: [\n"},
+		{name: "invalid value", file: "config.yaml", data: "balance_strategy: random\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(file, []byte(tt.data), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv(configFileEnv, file)
+			if _, err := load(); err == nil {
+				t.Errorf("load succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package stats
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const contextKey = "raychat.stats"
+
+// Stats is what a request did upstream, filled in by the endpoints and read by
+// the middlewares once the request is done
+type Stats struct {
+	RequestID        string
+	Model            string
+	Account          string
+	Stream           bool
+	PromptTokens     int
+	CompletionTokens int
+	UpstreamLatency  time.Duration
+	TimeToFirstToken time.Duration
+	// Completion is the text sent back to the client, kept for the audit log
+	Completion string
+}
+
+// FromContext returns the stats of the request, creating them on first use
+func FromContext(c *gin.Context) *Stats {
+	if v, ok := c.Get(contextKey); ok {
+		if s, ok := v.(*Stats); ok {
+			return s
+		}
+	}
+	s := &Stats{}
+	c.Set(contextKey, s)
+	return s
+}
+
+func (s *Stats) TotalTokens() int {
+	return s.PromptTokens + s.CompletionTokens
+}
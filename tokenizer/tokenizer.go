@@ -0,0 +1,89 @@
+package tokenizer
+
+import (
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	encoders = map[string]*tiktoken.Tiktoken{}
+	mu       sync.Mutex
+)
+
+func init() {
+	// the bpe ranks are embedded, never download them at runtime
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+}
+
+func Logger() *logrus.Entry {
+	return logrus.WithField("prefix", "tokenizer")
+}
+
+// encodingName picks the bpe of the model family, models of other vendors do
+// not publish their tokenizer and are counted with cl100k_base
+func encodingName(model string) string {
+	for _, prefix := range []string{"gpt-4o", "gpt-4.1", "gpt-4.5", "gpt-5", "o1", "o3", "o4", "chatgpt-4o"} {
+		if strings.HasPrefix(model, prefix) || strings.HasPrefix(model, "openai-"+prefix) {
+			return tiktoken.MODEL_O200K_BASE
+		}
+	}
+	return tiktoken.MODEL_CL100K_BASE
+}
+
+func encoder(model string) *tiktoken.Tiktoken {
+	name := encodingName(model)
+	mu.Lock()
+	defer mu.Unlock()
+	if enc, ok := encoders[name]; ok {
+		return enc
+	}
+	enc, err := tiktoken.GetEncoding(name)
+	if err != nil {
+		Logger().WithError(err).Errorf("load encoding %s failed", name)
+	}
+	encoders[name] = enc
+	return enc
+}
+
+// Count returns the number of tokens of text for model
+func Count(model, text string) int {
+	if len(text) == 0 {
+		return 0
+	}
+	enc := encoder(model)
+	if enc == nil {
+		return estimate(text)
+	}
+	return len(enc.EncodeOrdinary(text))
+}
+
+// Truncate returns the longest prefix of text within n tokens for model
+func Truncate(model, text string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	enc := encoder(model)
+	if enc == nil {
+		return text[:min(len(text), n*4)]
+	}
+	tokens := enc.EncodeOrdinary(text)
+	if len(tokens) <= n {
+		return text
+	}
+	truncated := enc.Decode(tokens[:n])
+	// the last token may end in the middle of a character
+	for len(truncated) > 0 && !utf8.ValidString(truncated) {
+		truncated = truncated[:len(truncated)-1]
+	}
+	return truncated
+}
+
+// estimate is used when no encoding could be loaded, about four bytes per token
+func estimate(text string) int {
+	return (len(text) + 3) / 4
+}
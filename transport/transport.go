@@ -0,0 +1,87 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"raychat/settings"
+	"sync"
+	"time"
+
+	"github.com/imroc/req/v3"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	mu         sync.Mutex
+	transports = map[string]*http.Transport{}
+)
+
+func Logger() *logrus.Entry {
+	return logrus.WithField("prefix", "transport")
+}
+
+// Get returns the transport used for all raycast traffic through proxy, there is
+// one per proxy so its keep-alive connections are shared. proxy is an http, https
+// or socks5 url, an empty proxy falls back to the HTTP_PROXY/HTTPS_PROXY env.
+func Get(proxy string) (*http.Transport, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if t, ok := transports[proxy]; ok {
+		return t, nil
+	}
+	proxyFunc := http.ProxyFromEnvironment
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q: %w", proxy, err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("invalid proxy %q: unsupported scheme %q", proxy, u.Scheme)
+		}
+		proxyFunc = http.ProxyURL(u)
+	}
+	conf := settings.Get()
+	t := &http.Transport{
+		Proxy: proxyFunc,
+		DialContext: (&net.Dialer{
+			Timeout:   conf.UpstreamConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: conf.UpstreamConnectTimeout,
+		MaxIdleConns:        conf.UpstreamMaxIdleConns,
+		MaxIdleConnsPerHost: conf.UpstreamMaxIdleConns,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	transports[proxy] = t
+	return t, nil
+}
+
+// Default returns the transport of the UPSTREAM_PROXY, the config is validated
+// on load but should an invalid proxy get here the proxy env is used instead
+func Default() *http.Transport {
+	proxy := settings.Get().UpstreamProxy
+	t, err := Get(proxy)
+	if err != nil {
+		Logger().WithError(err).Error("invalid UPSTREAM_PROXY, fall back to the proxy env")
+		t, _ = Get("")
+	}
+	return t
+}
+
+// Req returns a req client sending through t, req keeps its cookies, redirect
+// policy and body decoding while the connections come from the shared pool
+func Req(t http.RoundTripper) *req.Client {
+	if t == nil {
+		t = Default()
+	}
+	c := req.C()
+	c.GetTransport().WrapRoundTripFunc(func(http.RoundTripper) req.HttpRoundTripFunc {
+		return t.RoundTrip
+	})
+	return c
+}